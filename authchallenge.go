@@ -0,0 +1,64 @@
+package request
+
+import (
+	"strings"
+)
+
+// AuthChallenge is a challenge of the WWW-Authenticate response header.
+type AuthChallenge struct {
+	// Scheme is the authentication scheme, such as Basic or Bearer.
+	Scheme string
+	// Params are the auth-params of the challenge, keyed by their lower
+	// case names, e.g. realm or error.
+	Params map[string]string
+	// Token68 is set instead of Params by schemes such as Negotiate.
+	Token68 string
+}
+
+// AuthChallenges parses the WWW-Authenticate headers of the response, e.g.
+// `Bearer realm="x", error="invalid_token"`, so that a client can pick the
+// authentication flow the server asks for.
+func (r Result) AuthChallenges() []AuthChallenge {
+	var challenges []AuthChallenge
+	for _, value := range r.headers["Www-Authenticate"] {
+		for _, item := range splitQuoted(value, ',') {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if !isAuthParam(item) {
+				// a new challenge, with its first param or token68
+				scheme, rest := item, ""
+				if sp := strings.IndexAny(item, " \t"); sp >= 0 {
+					scheme, rest = item[:sp], strings.TrimSpace(item[sp+1:])
+				}
+				challenges = append(challenges, AuthChallenge{Scheme: scheme, Params: map[string]string{}})
+				if item = rest; item == "" {
+					continue
+				}
+			}
+			if len(challenges) == 0 {
+				continue
+			}
+			c := &challenges[len(challenges)-1]
+			if !isAuthParam(item) {
+				c.Token68 = item
+				continue
+			}
+			eq := strings.Index(item, "=")
+			key := strings.ToLower(strings.TrimSpace(item[:eq]))
+			c.Params[key] = unquote(strings.TrimSpace(item[eq+1:]))
+		}
+	}
+	return challenges
+}
+
+// isAuthParam reports whether s is a name=value auth-param rather than a
+// scheme or a token68, whose trailing '=' are padding.
+func isAuthParam(s string) bool {
+	eq := strings.Index(s, "=")
+	if eq <= 0 || strings.TrimSpace(s[eq+1:]) == "" || strings.HasPrefix(s[eq+1:], "=") {
+		return false
+	}
+	return !strings.ContainsAny(strings.TrimSpace(s[:eq]), " \t\"")
+}
@@ -0,0 +1,27 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestResult_AuthChallenges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="x", error="invalid_token", error_description="expired, renew"`)
+		w.Header().Add("WWW-Authenticate", `Basic realm="legacy", Negotiate abc123==`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	challenges := NewRequest(srv.URL, "GET").Do().AuthChallenges()
+	want := []AuthChallenge{
+		{Scheme: "Bearer", Params: map[string]string{"realm": "x", "error": "invalid_token", "error_description": "expired, renew"}},
+		{Scheme: "Basic", Params: map[string]string{"realm": "legacy"}},
+		{Scheme: "Negotiate", Params: map[string]string{}, Token68: "abc123=="},
+	}
+	if !reflect.DeepEqual(challenges, want) {
+		t.Errorf("challenges = %+v", challenges)
+	}
+}
@@ -0,0 +1,47 @@
+package request
+
+import (
+	"context"
+	"sync"
+)
+
+// DoBatch sends reqs with at most concurrency requests in flight and returns
+// their results in the same order. Requests without a context of their own
+// use ctx; once ctx is done, the requests not yet sent fail with its error.
+func DoBatch(ctx context.Context, reqs []*Request, concurrency int) []Result {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if concurrency <= 0 || concurrency > len(reqs) {
+		concurrency = len(reqs)
+	}
+
+	results := make([]Result, len(reqs))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					results[i] = Result{err: err}
+					continue
+				}
+				req := reqs[i]
+				if req.ctx == nil {
+					req.Context(ctx)
+				}
+				results[i] = req.Do()
+			}
+		}()
+	}
+
+	for i := range reqs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
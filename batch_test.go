@@ -0,0 +1,60 @@
+package request
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoBatch(t *testing.T) {
+	var inFlight, maxInFlight int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		_, _ = w.Write([]byte(r.URL.Query().Get("i")))
+	}))
+	defer srv.Close()
+
+	reqs := make([]*Request, 20)
+	for i := range reqs {
+		reqs[i] = NewRequest(srv.URL, "GET").Param("i", strconv.Itoa(i))
+	}
+
+	results := DoBatch(context.Background(), reqs, 4)
+	if len(results) != len(reqs) {
+		t.Fatalf("got %d results", len(results))
+	}
+	for i, res := range results {
+		body, err := res.Raw()
+		if err != nil {
+			t.Fatalf("result %d: %v", i, err)
+		}
+		if string(body) != strconv.Itoa(i) {
+			t.Errorf("result %d = %q", i, body)
+		}
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 4 {
+		t.Errorf("%d requests were in flight", max)
+	}
+}
+
+func TestDoBatch_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results := DoBatch(ctx, []*Request{NewRequest("http://127.0.0.1:1", "GET")}, 1)
+	if _, err := results[0].Raw(); err != context.Canceled {
+		t.Errorf("err = %v", err)
+	}
+}
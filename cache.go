@@ -0,0 +1,92 @@
+package request
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ETagCache keeps the last successful response to GET requests, keyed by
+// URL, and revalidates it with If-None-Match. A 304 Not Modified reply is
+// then served from the cache. The zero value is ready to use.
+type ETagCache struct {
+	mu      sync.Mutex
+	entries map[string]Result
+	// order lists the keys of entries, least recently used first.
+	order []string
+}
+
+// maxETagCacheEntries bounds an ETagCache. The least recently used response
+// is dropped beyond it.
+const maxETagCacheEntries = 256
+
+// Cache makes GET requests revalidate and reuse responses kept in c.
+func (r *Request) Cache(c *ETagCache) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.cache = c
+	return r
+}
+
+// etag returns the ETag of the response cached for key.
+func (c *ETagCache) etag(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	return cached.Header("ETag"), true
+}
+
+// update stores result when it carries an ETag, or replaces a 304 result
+// with the cached response.
+func (c *ETagCache) update(key string, result Result) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case result.statusCode == http.StatusNotModified:
+		cached, ok := c.entries[key]
+		if !ok {
+			return result
+		}
+		c.touch(key)
+		cached.request = result.request
+		cached.url = result.url
+		cached.tlsState = result.tlsState
+		cached.fromCache = true
+		return cached
+	case result.err == nil && result.statusCode == http.StatusOK && result.spill == nil && result.Header("ETag") != "":
+		if c.entries == nil {
+			c.entries = map[string]Result{}
+		}
+		if _, ok := c.entries[key]; ok {
+			c.touch(key)
+		} else {
+			if len(c.order) >= maxETagCacheEntries {
+				delete(c.entries, c.order[0])
+				c.order = c.order[1:]
+			}
+			c.order = append(c.order, key)
+		}
+		c.entries[key] = Result{
+			body:        result.body,
+			contentType: result.contentType,
+			statusCode:  result.statusCode,
+			decoder:     result.decoder,
+			headers:     result.headers,
+			cookies:     result.cookies,
+		}
+	}
+	return result
+}
+
+// touch marks key as the most recently used.
+func (c *ETagCache) touch(key string) {
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(append(c.order[:i:i], c.order[i+1:]...), key)
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package request
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequest_Cache(t *testing.T) {
+	var sent int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		sent++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"a"}`))
+	}))
+	defer srv.Close()
+
+	var cache ETagCache
+	res := NewRequest(srv.URL, "GET").Cache(&cache).Do()
+	if res.Error() != nil || res.FromCache() {
+		t.Fatalf("first request: %v, from cache %v", res.Error(), res.FromCache())
+	}
+
+	res = NewRequest(srv.URL, "GET").Cache(&cache).Do()
+	var out struct{ Name string }
+	if err := res.Into(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !res.FromCache() || res.HttpStatusCode() != http.StatusOK || out.Name != "a" {
+		t.Errorf("from cache %v, status %d, name %q", res.FromCache(), res.HttpStatusCode(), out.Name)
+	}
+	if sent != 1 {
+		t.Errorf("body sent %d times", sent)
+	}
+}
+
+func TestETagCache_Bounded(t *testing.T) {
+	var c ETagCache
+	stored := Result{statusCode: http.StatusOK, headers: http.Header{"Etag": []string{`"v1"`}}}
+	for i := 0; i <= maxETagCacheEntries; i++ {
+		c.update(fmt.Sprintf("/%d", i), stored)
+		if i == 0 {
+			continue
+		}
+		// keep the first entry in use.
+		c.update("/0", Result{statusCode: http.StatusNotModified})
+	}
+	if len(c.entries) != maxETagCacheEntries || len(c.order) != maxETagCacheEntries {
+		t.Errorf("%d entries, %d keys", len(c.entries), len(c.order))
+	}
+	if _, ok := c.etag("/0"); !ok {
+		t.Error("the recently used entry was dropped")
+	}
+	if _, ok := c.etag("/1"); ok {
+		t.Error("the least recently used entry was kept")
+	}
+}
@@ -0,0 +1,36 @@
+package request
+
+import (
+	"context"
+	"net/http"
+)
+
+// Credentials authenticate a single attempt of a request. A BearerToken is
+// sent when set, otherwise Username and Password as basic auth.
+type Credentials struct {
+	BearerToken string
+	Username    string
+	Password    string
+}
+
+// apply sets the Authorization header of req.
+func (c Credentials) apply(req *http.Request) {
+	switch {
+	case c.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	case c.Username != "" || c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// CredentialsFromContext sets a function that returns the credentials of
+// every attempt from the context of the request, e.g. the token of the
+// tenant being served. It is called again on retries, so rotated tokens are
+// picked up, and takes precedence over an Authorization header.
+func (r *Request) CredentialsFromContext(fn func(ctx context.Context) (Credentials, error)) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.credentials = fn
+	return r
+}
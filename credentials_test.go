@@ -0,0 +1,50 @@
+package request
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type tenantKey struct{}
+
+func TestRequest_CredentialsFromContext(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		if len(got) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	issued := 0
+	provider := func(ctx context.Context) (Credentials, error) {
+		issued++
+		return Credentials{BearerToken: fmt.Sprintf("%s-%d", ctx.Value(tenantKey{}), issued)}, nil
+	}
+
+	for _, tenant := range []string{"a", "b"} {
+		ctx := context.WithValue(context.Background(), tenantKey{}, tenant)
+		err := NewRequest(srv.URL, "GET").Context(ctx).Header("Authorization", "Bearer static").
+			CredentialsFromContext(provider).Do().Error()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"Bearer a-1", "Bearer a-2", "Bearer b-3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err := NewRequest(srv.URL, "GET").CredentialsFromContext(func(ctx context.Context) (Credentials, error) {
+		return Credentials{}, fmt.Errorf("no tenant")
+	}).Do().Raw()
+	if err == nil || len(got) != 3 {
+		t.Errorf("err = %v, %d requests", err, len(got))
+	}
+}
@@ -0,0 +1,100 @@
+package request
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ToCurl returns a curl command that sends the same request as Do, for
+// reproducing calls in bug reports. Binary bodies are written with ANSI-C
+// quoting so that the command stays on one line.
+func (r *Request) ToCurl() (string, error) {
+	body, err := r.BodyBytes()
+	if err != nil {
+		return "", err
+	}
+	req, err := r.HTTPRequest()
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"curl", "-X", shellQuote(req.Method), shellQuote(req.URL.String())}
+	if r.insecureSkipVerify() {
+		args = append(args, "--insecure")
+	}
+	keys := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range req.Header[k] {
+			args = append(args, "-H", shellQuote(k+": "+v))
+		}
+	}
+	if len(body) > 0 {
+		if isPrintable(body) {
+			args = append(args, "--data-raw", shellQuote(string(body)))
+		} else {
+			args = append(args, "--data-binary", ansiQuote(body))
+		}
+	}
+	return strings.Join(args, " "), nil
+}
+
+// insecureSkipVerify reports whether the client skips TLS verification,
+// without taking ownership of its transport.
+func (r *Request) insecureSkipVerify() bool {
+	if r.client == nil {
+		return false
+	}
+	t, ok := r.client.Transport.(*http.Transport)
+	return ok && t.TLSClientConfig != nil && t.TLSClientConfig.InsecureSkipVerify
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./:=@", c))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// ansiQuote quotes data as a $'...' string, escaping every byte that is not
+// printable ASCII.
+func ansiQuote(data []byte) string {
+	var b strings.Builder
+	b.WriteString("$'")
+	for _, c := range data {
+		switch {
+		case c == '\'' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// isPrintable reports whether data is text that can be passed in single
+// quotes as is.
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, c := range string(data) {
+		if c < 0x20 && c != '\n' && c != '\r' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package request
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequest_ToCurl(t *testing.T) {
+	cmd, err := NewRequest("https://example.com", "POST").Prefix("users").
+		Header("X-Note", "it's").Body([]byte(`{"name":"alice"}`)).ToCurl()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	for _, want := range []string{
+		"curl -X POST https://example.com/users",
+		`-H 'X-Note: it'\''s'`,
+		`--data-raw '{"name":"alice"}'`,
+		"--insecure",
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Errorf("%s does not contain %s", cmd, want)
+		}
+	}
+
+	cmd, err = NewRequest("http://example.com", "PUT").Body([]byte{0, 'a', '\''}).ToCurl()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if !strings.HasSuffix(cmd, `--data-binary $'\x00a\''`) || strings.Contains(cmd, "--insecure") {
+		t.Errorf("binary body: %s", cmd)
+	}
+}
@@ -0,0 +1,130 @@
+package request
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MaxDecodeDepth rejects JSON, XML and YAML responses nested deeper than n
+// objects, arrays or elements when they are decoded by Into, protecting
+// against payloads crafted to exhaust the stack or memory. JSON and XML are
+// checked by a streaming scan before they are decoded.
+func (r *Request) MaxDecodeDepth(n int) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.maxDepth = n
+	return r
+}
+
+// checkDepth returns an error when data of mediaType is nested deeper than
+// max. Media types it does not know are not checked.
+func checkDepth(data []byte, mediaType string, max int) error {
+	var depth int
+	var err error
+	switch mediaType {
+	case "application/json":
+		depth, err = jsonDepth(data, max)
+	case "application/xml", "text/xml":
+		depth, err = xmlDepth(data, max)
+	case "application/yaml":
+		depth, err = yamlDepth(data)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if depth > max {
+		return fmt.Errorf("%s response exceeds the maximum nesting depth of %d", mediaType, max)
+	}
+	return nil
+}
+
+// jsonDepth scans the JSON tokens of data, stopping as soon as the depth
+// exceeds max.
+func jsonDepth(data []byte, max int) (int, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth, deepest := 0, 0
+	for deepest <= max {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return deepest, nil
+}
+
+// xmlDepth scans the XML elements of data, stopping as soon as the depth
+// exceeds max.
+func xmlDepth(data []byte, max int) (int, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	depth, deepest := 0, 0
+	for deepest <= max {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return deepest, nil
+}
+
+// yamlDepth decodes data to measure its depth, as the YAML parser has no
+// streaming API.
+func yamlDepth(data []byte) (int, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return 0, err
+	}
+	return valueDepth(v), nil
+}
+
+func valueDepth(v interface{}) int {
+	deepest := 0
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for _, e := range v {
+			if d := valueDepth(e); d > deepest {
+				deepest = d
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if d := valueDepth(e); d > deepest {
+				deepest = d
+			}
+		}
+	default:
+		return 0
+	}
+	return deepest + 1
+}
@@ -0,0 +1,42 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequest_MaxDecodeDepth(t *testing.T) {
+	var contentType, payload string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+
+	nested := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + strings.Repeat(close, n)
+	}
+	for _, c := range []struct {
+		contentType, shallow, deep string
+	}{
+		{"application/json", nested("[", "]", 10), nested("[", "]", 11)},
+		{"application/xml", nested("<a>", "</a>", 10), nested("<a>", "</a>", 11)},
+		{"application/yaml", nested("[", "]", 10), nested("[", "]", 11)},
+	} {
+		contentType = c.contentType
+		var out interface{}
+
+		payload = c.shallow
+		if err := NewRequest(srv.URL, "GET").MaxDecodeDepth(10).Do().Into(&out); err != nil {
+			t.Errorf("%s: depth 10 rejected: %v", c.contentType, err)
+		}
+
+		payload = c.deep
+		err := NewRequest(srv.URL, "GET").MaxDecodeDepth(10).Do().Into(&out)
+		if err == nil || !strings.Contains(err.Error(), "maximum nesting depth of 10") {
+			t.Errorf("%s: depth 11 err = %v", c.contentType, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package request
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// connDialer dials the connections of a transport, applying per-read and
+// per-write deadlines to them.
+type connDialer struct {
+	*net.Dialer
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// addr, when set, is dialed instead of the address of the request.
+	addr string
+}
+
+func newConnDialer() *connDialer {
+	return &connDialer{
+		Dialer: &net.Dialer{
+			Timeout:   time.Duration(30 * time.Second),
+			KeepAlive: time.Duration(30 * time.Second),
+		},
+	}
+}
+
+func (d *connDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.addr != "" {
+		addr = d.addr
+	}
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.readTimeout <= 0 && d.writeTimeout <= 0 {
+		return conn, nil
+	}
+	return &deadlineConn{Conn: conn, readTimeout: d.readTimeout, writeTimeout: d.writeTimeout}, nil
+}
+
+// deadlineConn resets the read or write deadline of the connection before
+// every read or write.
+type deadlineConn struct {
+	net.Conn
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
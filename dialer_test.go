@@ -0,0 +1,253 @@
+package request
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// trickleServer answers every connection with a response whose body is sent
+// one byte per interval.
+func trickleServer(t *testing.T, interval time.Duration) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"))
+				for _, b := range []byte("hello") {
+					time.Sleep(interval)
+					if _, err := conn.Write([]byte{b}); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestRequest_ReadTimeout(t *testing.T) {
+	ln := trickleServer(t, 100*time.Millisecond)
+	defer ln.Close()
+
+	if _, err := NewRequest(ln.Addr().String(), "GET").ReadTimeout(20 * time.Millisecond).Do().Raw(); err == nil {
+		t.Error("expected the trickled response to exceed the read timeout")
+	}
+
+	body, err := NewRequest(ln.Addr().String(), "GET").ReadTimeout(time.Second).WriteTimeout(time.Second).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "hello" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestRequest_KeepAlivePeriod(t *testing.T) {
+	req := NewRequest("http://127.0.0.1/", "GET")
+	if sharedDialer.KeepAlive != 30*time.Second {
+		t.Errorf("default keep-alive = %v", sharedDialer.KeepAlive)
+	}
+	if req.KeepAlivePeriod(60 * time.Second); req.dialer.KeepAlive != 60*time.Second {
+		t.Errorf("keep-alive = %v", req.dialer.KeepAlive)
+	}
+	if req.KeepAlivePeriod(0); req.dialer.KeepAlive >= 0 {
+		t.Errorf("keep-alive = %v, want it disabled", req.dialer.KeepAlive)
+	}
+
+	// a client of the caller gets a copy of its transport dialing with the
+	// request's dialer.
+	client := &http.Client{Transport: &http.Transport{}}
+	req = NewRequest("http://127.0.0.1/", "GET").HttpClient(client).KeepAlivePeriod(time.Minute)
+	if req.dialer.KeepAlive != time.Minute || req.client == client {
+		t.Errorf("keep-alive = %v, client replaced = %v", req.dialer.KeepAlive, req.client != client)
+	}
+}
+
+// countingListener tracks how many of its connections are open at once.
+type countingListener struct {
+	net.Listener
+	mu         sync.Mutex
+	open, peak int
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.open++
+	if l.open > l.peak {
+		l.peak = l.open
+	}
+	l.mu.Unlock()
+	return &countedConn{Conn: conn, l: l}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	l    *countingListener
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.l.mu.Lock()
+		c.l.open--
+		c.l.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func TestRequest_MaxConnsPerHost(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	ln := &countingListener{Listener: srv.Listener}
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	client := NewRequest(srv.URL, "GET").MaxConnsPerHost(2).client
+	reqs := make([]*Request, 10)
+	for i := range reqs {
+		reqs[i] = NewRequest(srv.URL, "GET").HttpClient(client)
+	}
+	for i, res := range DoBatch(context.Background(), reqs, len(reqs)) {
+		if err := res.Error(); err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.peak > 2 {
+		t.Errorf("%d connections were open at once, want at most 2", ln.peak)
+	}
+}
+
+func TestRequest_DialAddr(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest("http://edge.example.invalid/", "GET").
+		DialAddr(srv.Listener.Addr().String()).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "edge.example.invalid" {
+		t.Errorf("Host = %q", body)
+	}
+}
+
+// authProxy is a forward proxy that requires basic auth. It answers plain
+// HTTP requests itself and tunnels CONNECT requests.
+func authProxy() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := (&http.Request{Header: http.Header{
+			"Authorization": r.Header["Proxy-Authorization"],
+		}}).BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != "CONNECT" {
+			_, _ = w.Write([]byte("proxied " + r.URL.String()))
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			defer upstream.Close()
+			_, _ = io.Copy(upstream, rw)
+		}()
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, upstream)
+		}()
+	}))
+}
+
+func TestRequest_ProxyAuth(t *testing.T) {
+	proxy := authProxy()
+	defer proxy.Close()
+
+	body, err := NewRequest("http://example.invalid/path", "GET").Proxy(proxy.URL).
+		ProxyAuth("alice", "secret").Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "proxied http://example.invalid/path" {
+		t.Errorf("body = %q", body)
+	}
+	if err := NewRequest("http://example.invalid/path", "GET").Proxy(proxy.URL).Do().Error(); err == nil {
+		t.Error("expected 407 without credentials")
+	}
+
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tunneled " + r.Header.Get("Proxy-Authorization")))
+	}))
+	defer target.Close()
+	body, err = NewRequest(target.URL, "GET").Proxy(proxy.URL).ProxyAuth("alice", "secret").Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	// the credentials stay with the proxy.
+	if string(body) != "tunneled " {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestRequest_ProxyAuthDirect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Proxy-Authorization")))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "GET").ProxyAuth("alice", "secret").Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if len(body) != 0 {
+		t.Errorf("direct request carried Proxy-Authorization %q", body)
+	}
+
+	proxy := authProxy()
+	defer proxy.Close()
+	body, err = NewRequest("http://example.invalid/path", "GET").ProxyAuth("alice", "secret").
+		Proxy(proxy.URL).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "proxied http://example.invalid/path" {
+		t.Errorf("body = %q", body)
+	}
+}
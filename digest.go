@@ -0,0 +1,62 @@
+package request
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strings"
+)
+
+// digests are the algorithms supported by ContentDigest.
+var digests = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// ContentDigest sets a digest of the body computed with algo, which is
+// "md5", sent as Content-MD5, or "sha-256" or "sha-512", sent as
+// "Digest: <algo>=<base64>". The body is buffered to compute it, after any
+// compression set with GzipBody.
+func (r *Request) ContentDigest(algo string) *Request {
+	if r.err != nil {
+		return r
+	}
+	algo = strings.ToLower(algo)
+	if _, ok := digests[algo]; !ok {
+		r.err = fmt.Errorf("unsupported digest algorithm %q", algo)
+		return r
+	}
+	r.digest = algo
+	return r
+}
+
+// setDigest buffers the body and sets the header of the digest algorithm.
+func (r *Request) setDigest() error {
+	if err := r.bufferBody(); err != nil {
+		return err
+	}
+	var data []byte
+	if r.body != nil {
+		var err error
+		if data, err = ioutil.ReadAll(r.body); err != nil {
+			return err
+		}
+		r.body = bytes.NewReader(data)
+	}
+
+	h := digests[r.digest]()
+	_, _ = h.Write(data)
+	sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if r.digest == "md5" {
+		r.Header("Content-MD5", sum)
+		return nil
+	}
+	r.Header("Digest", r.digest+"="+sum)
+	return nil
+}
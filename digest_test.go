@@ -0,0 +1,40 @@
+package request
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequest_ContentDigest(t *testing.T) {
+	var md5Sum, digest, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		md5Sum, digest = r.Header.Get("Content-MD5"), r.Header.Get("Digest")
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer srv.Close()
+
+	if err := NewRequest(srv.URL, "PUT").Body([]byte("hello world")).ContentDigest("md5").Do().Error(); err != nil {
+		t.Fatal(err)
+	}
+	if md5Sum != "XrY7u+Ae7tCTyyK7j1rNww==" || body != "hello world" {
+		t.Errorf("Content-MD5 = %q, body = %q", md5Sum, body)
+	}
+
+	// a streamed body is buffered to compute the digest.
+	err := NewRequest(srv.URL, "PUT").ContentDigest("SHA-256").
+		BodyReader(onlyReader{strings.NewReader("hello world")}, 11).Do().Error()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha-256=uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=" || body != "hello world" {
+		t.Errorf("Digest = %q, body = %q", digest, body)
+	}
+
+	if err := NewRequest(srv.URL, "PUT").ContentDigest("crc32").Do().Error(); err == nil {
+		t.Error("expected an unsupported algorithm error")
+	}
+}
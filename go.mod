@@ -1,8 +1,11 @@
 module github.com/kplcloud/request
 
-go 1.12
+go 1.13
 
 require (
+	github.com/moby/spdystream v0.2.0
+	github.com/xeipuuv/gojsonschema v1.2.0
 	golang.org/x/net v0.0.0-20190827160401-ba9fcec4b297
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,60 @@
+package request
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// JSONString returns the string at key in a JSON body. key is a dot
+// separated path into nested objects, where a numeric segment indexes an
+// array, e.g. "items.0.name". ok is false when the key is missing, holds
+// another type or the result failed.
+func (r Result) JSONString(key string) (value string, ok bool) {
+	value, ok = r.jsonValue(key).(string)
+	return value, ok
+}
+
+// JSONInt is like JSONString for integers.
+func (r Result) JSONInt(key string) (int64, bool) {
+	n, ok := r.jsonValue(key).(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.Int64()
+	return i, err == nil
+}
+
+// JSONBool is like JSONString for booleans.
+func (r Result) JSONBool(key string) (value bool, ok bool) {
+	value, ok = r.jsonValue(key).(bool)
+	return value, ok
+}
+
+// jsonValue returns the value at the dot separated path key, or nil.
+func (r Result) jsonValue(key string) interface{} {
+	if r.err != nil {
+		return nil
+	}
+	dec := json.NewDecoder(r.BodyReader())
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil
+	}
+	for _, segment := range strings.Split(key, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[segment]
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
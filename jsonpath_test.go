@@ -0,0 +1,41 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResult_JSONAccessors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"user":{"name":"alice","age":42,"admin":true},"tags":[{"id":7}]}`))
+	}))
+	defer srv.Close()
+
+	res := NewRequest(srv.URL, "GET").Do()
+	if v, ok := res.JSONString("user.name"); !ok || v != "alice" {
+		t.Errorf("user.name = %q, %v", v, ok)
+	}
+	if v, ok := res.JSONInt("user.age"); !ok || v != 42 {
+		t.Errorf("user.age = %d, %v", v, ok)
+	}
+	if v, ok := res.JSONInt("tags.0.id"); !ok || v != 7 {
+		t.Errorf("tags.0.id = %d, %v", v, ok)
+	}
+	if v, ok := res.JSONBool("user.admin"); !ok || !v {
+		t.Errorf("user.admin = %v, %v", v, ok)
+	}
+
+	for _, key := range []string{"user.email", "tags.1.id", "user.name.first", "missing"} {
+		if _, ok := res.JSONString(key); ok {
+			t.Errorf("%s found", key)
+		}
+	}
+	if _, ok := res.JSONInt("user.name"); ok {
+		t.Error("user.name read as an int")
+	}
+	if _, ok := res.JSONBool("user.age"); ok {
+		t.Error("user.age read as a bool")
+	}
+}
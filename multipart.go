@@ -0,0 +1,139 @@
+package request
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// multipartPart is a field or a file of a multipart/form-data body.
+type multipartPart struct {
+	field       string
+	filename    string
+	contentType string
+	value       string
+	content     io.Reader
+	// closer, if set, is closed once the body has been written.
+	closer io.Closer
+}
+
+// MultipartField adds a form field to a multipart/form-data body.
+func (r *Request) MultipartField(name, value string) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.multipart = append(r.multipart, multipartPart{field: name, value: value})
+	return r
+}
+
+// MultipartFile adds a file to a multipart/form-data body. The Content-Type
+// of the part is detected from the extension of filename, falling back to
+// application/octet-stream. content is streamed when the request is sent.
+func (r *Request) MultipartFile(field, filename string, content io.Reader) *Request {
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return r.MultipartFileWithType(field, filename, contentType, content)
+}
+
+// MultipartFileFromPath adds the file at path to a multipart/form-data body
+// like MultipartFile, named after its base name. The file is streamed when
+// the request is sent and closed afterwards.
+func (r *Request) MultipartFileFromPath(field, path string) *Request {
+	if r.err != nil {
+		return r
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.MultipartFile(field, filepath.Base(path), f)
+	r.multipart[len(r.multipart)-1].closer = f
+	return r
+}
+
+// MultipartFileWithType is like MultipartFile with an explicit Content-Type
+// for the part.
+func (r *Request) MultipartFileWithType(field, filename, contentType string, content io.Reader) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.multipart = append(r.multipart, multipartPart{
+		field:       field,
+		filename:    filename,
+		contentType: contentType,
+		content:     content,
+	})
+	return r
+}
+
+// streamMultipart turns the multipart parts into a body that is written
+// while it is sent. Such a body cannot be replayed by retries unless it is
+// buffered first, e.g. by BodyBytes.
+func (r *Request) streamMultipart() {
+	parts := r.multipart
+	r.multipart = nil
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	r.body = pr
+	r.bodyLength = 0
+	r.Header("Content-Type", mw.FormDataContentType())
+	go func() {
+		defer func() {
+			for _, part := range parts {
+				if part.closer != nil {
+					_ = part.closer.Close()
+				}
+			}
+		}()
+		for _, part := range parts {
+			if err := writePart(mw, part); err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+		_ = pw.CloseWithError(mw.Close())
+	}()
+}
+
+// releaseBody frees what a body written while it is sent holds on to: the
+// files of parts that were not streamed, and the goroutine writing a
+// streamed body, which stops once its reader is closed. It is called when a
+// request is done, or fails before sending.
+func (r *Request) releaseBody() {
+	for _, part := range r.multipart {
+		if part.closer != nil {
+			_ = part.closer.Close()
+		}
+	}
+	r.multipart = nil
+	if pr, ok := r.body.(*io.PipeReader); ok {
+		_ = pr.Close()
+	}
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func writePart(mw *multipart.Writer, part multipartPart) error {
+	if part.content == nil {
+		return mw.WriteField(part.field, part.value)
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(part.field), quoteEscaper.Replace(part.filename)))
+	h.Set("Content-Type", part.contentType)
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, part.content)
+	return err
+}
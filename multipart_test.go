@@ -0,0 +1,120 @@
+package request
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequest_MultipartFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, field := range []string{"image", "data"} {
+			fh := r.MultipartForm.File[field][0]
+			_, _ = w.Write([]byte(fh.Filename + " " + fh.Header.Get("Content-Type") + "\n"))
+		}
+		_, _ = w.Write([]byte(r.FormValue("name")))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "POST").
+		MultipartField("name", "avatar").
+		MultipartFile("image", "logo.png", strings.NewReader("\x89PNG")).
+		MultipartFileWithType("data", "logo.png", "application/x-custom", strings.NewReader("x")).
+		Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	want := "logo.png image/png\nlogo.png application/x-custom\navatar"
+	if string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestRequest_MultipartFileFromPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.json")
+	if err := ioutil.WriteFile(path, []byte(`{"ok":true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, fh, err := r.FormFile("report")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		data, _ := ioutil.ReadAll(f)
+		_, _ = w.Write([]byte(fh.Filename + " " + fh.Header.Get("Content-Type") + " " + string(data)))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "POST").MultipartFileFromPath("report", path).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != `report.json application/json {"ok":true}` {
+		t.Errorf("server saw %q", body)
+	}
+
+	err = NewRequest(srv.URL, "POST").MultipartFileFromPath("report", filepath.Join(dir, "missing")).Do().Error()
+	if !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
+
+func TestRequest_MultipartFileFromPathReleased(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.txt")
+	if err := ioutil.WriteFile(path, []byte("quarterly numbers"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + ln.Addr().String()
+	_ = ln.Close()
+
+	for name, req := range map[string]*Request{
+		"builder error": NewRequest(down, "POST").MultipartFileFromPath("report", path),
+		"rejected":      NewRequest(down, "GET").AllowGetBody(false).MultipartFileFromPath("report", path),
+		"dial error":    NewRequest(down, "POST").MultipartFileFromPath("report", path),
+	} {
+		f := req.multipart[0].closer.(*os.File)
+		if name == "builder error" {
+			req.err = errors.New("invalid request")
+		}
+		if err := req.Do().Error(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		closed := false
+		for deadline := time.Now().Add(time.Second); !closed && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			_, err := f.Stat()
+			closed = errors.Is(err, os.ErrClosed)
+		}
+		if !closed {
+			t.Errorf("%s: the file was left open", name)
+			_ = f.Close()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// NDJSONReader decodes a newline-delimited JSON stream, such as the body
+// returned by Stream, one record at a time. Nothing is read ahead of the
+// record being decoded, so a slow caller slows down the server.
+type NDJSONReader struct {
+	rc   io.ReadCloser
+	r    *bufio.Reader
+	line int
+}
+
+// NewNDJSONReader returns a reader of the records of rc.
+func NewNDJSONReader(rc io.ReadCloser) *NDJSONReader {
+	return &NDJSONReader{rc: rc, r: bufio.NewReader(rc)}
+}
+
+// Next decodes the next record into v. Blank lines are skipped. It returns
+// io.EOF at the end of the stream, and io.ErrUnexpectedEOF when the stream
+// ends in the middle of a record; a last record without a trailing newline
+// is decoded.
+func (n *NDJSONReader) Next(v interface{}) error {
+	for {
+		line, err := n.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		n.line++
+		record := bytes.TrimSpace(line)
+		if len(record) == 0 {
+			if err == io.EOF {
+				return io.EOF
+			}
+			continue
+		}
+		if decodeErr := json.Unmarshal(record, v); decodeErr != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("ndjson line %d: %v", n.line, decodeErr)
+		}
+		return nil
+	}
+}
+
+// Close closes the underlying stream.
+func (n *NDJSONReader) Close() error {
+	return n.rc.Close()
+}
@@ -0,0 +1,49 @@
+package request
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNDJSONReader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_, _ = w.Write([]byte("{\"id\":1}\n\n{\"id\":2}\r\n"))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(`{"id":3}`))
+	}))
+	defer srv.Close()
+
+	rc, err := NewRequest(srv.URL, "GET").Stream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := NewNDJSONReader(rc)
+	defer records.Close()
+
+	for want := 1; want <= 3; want++ {
+		var record struct{ ID int }
+		if err := records.Next(&record); err != nil {
+			t.Fatalf("record %d: %v", want, err)
+		}
+		if record.ID != want {
+			t.Errorf("id = %d, want %d", record.ID, want)
+		}
+	}
+	var record struct{ ID int }
+	if err := records.Next(&record); err != io.EOF {
+		t.Errorf("err = %v, want io.EOF", err)
+	}
+
+	truncated := NewNDJSONReader(ioutil.NopCloser(strings.NewReader("{\"id\":1}\n{\"id\"")))
+	if err := truncated.Next(&record); err != nil {
+		t.Fatal(err)
+	}
+	if err := truncated.Next(&record); err != io.ErrUnexpectedEOF {
+		t.Errorf("err = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
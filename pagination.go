@@ -0,0 +1,155 @@
+package request
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// defaultMaxPages bounds DoAll and DoCursor unless MaxPages is set.
+const defaultMaxPages = 1000
+
+// credentialHeaders are not sent to another host by NextPage, like
+// net/http does when following redirects.
+var credentialHeaders = []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"}
+
+// MaxPages limits how many pages DoAll and DoCursor fetch before failing,
+// 1000 by default.
+func (r *Request) MaxPages(n int) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.maxPages = n
+	return r
+}
+
+func (r *Request) pageLimit() int {
+	if r.maxPages > 0 {
+		return r.maxPages
+	}
+	return defaultMaxPages
+}
+
+// parseLinkHeader parses RFC 5988 Link header values into a map of relation
+// type to target, e.g. `<https://api/items?page=2>; rel="next"`.
+func parseLinkHeader(values []string) map[string]string {
+	links := map[string]string{}
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			target = target[1 : len(target)-1]
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(strings.ToLower(param), "rel=") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(param[len("rel="):], `"`)) {
+					rel = strings.ToLower(rel)
+					if _, ok := links[rel]; !ok {
+						links[rel] = target
+					}
+				}
+			}
+		}
+	}
+	return links
+}
+
+// NextPage returns a request for the page the response links to with
+// rel="next", keeping the client, headers and options of the request that
+// produced the result. Credentials are dropped when the link points to
+// another host. It returns false on the last page.
+func (r Result) NextPage() (*Request, bool) {
+	if r.request == nil || r.url == nil {
+		return nil, false
+	}
+	target, ok := parseLinkHeader(r.headers["Link"])["next"]
+	if !ok {
+		return nil, false
+	}
+	ref, err := url.Parse(target)
+	if err != nil {
+		return nil, false
+	}
+
+	targetURL := r.url.ResolveReference(ref)
+	next := r.request.clone()
+	next.setAbsoluteURL(targetURL)
+	if targetURL.Host != r.url.Host || targetURL.Scheme != r.url.Scheme {
+		for _, name := range credentialHeaders {
+			next.headers.Del(name)
+		}
+		next.credentials = nil
+		next.signer = nil
+	}
+	return next, true
+}
+
+// DoAll sends the request and follows the rel="next" links of the responses
+// until the last page, calling accumulate with every page. It stops at the
+// first error, whether returned by a request or by accumulate, and fails
+// when a link leads back to a page already fetched or after MaxPages pages.
+func (r *Request) DoAll(accumulate func(Result) error) error {
+	req := r
+	seen := map[string]bool{}
+	for pages := 0; ; pages++ {
+		if pages == r.pageLimit() {
+			return fmt.Errorf("DoAll: stopped after %d pages", pages)
+		}
+		u := req.URL().String()
+		if seen[u] {
+			return fmt.Errorf("DoAll: the next link leads back to %s", u)
+		}
+		seen[u] = true
+		res := req.Do()
+		if res.err != nil {
+			return res.Error()
+		}
+		if err := accumulate(res); err != nil {
+			return err
+		}
+		next, ok := res.NextPage()
+		if !ok {
+			return nil
+		}
+		req = next
+	}
+}
+
+// DoCursor pages through an API that returns the cursor of the next page in
+// its body. It sends the request, calls accumulate with the page, extracts
+// the next cursor with cursor, then repeats the request with the cursor as
+// the param named param until the cursor is empty or MaxPages pages were
+// fetched.
+func (r *Request) DoCursor(param string, cursor func(Result) (string, error), accumulate func(Result) error) error {
+	req := r
+	for pages := 0; ; pages++ {
+		if pages == r.pageLimit() {
+			return fmt.Errorf("DoCursor: stopped after %d pages", pages)
+		}
+		res := req.Do()
+		if res.err != nil {
+			return res.Error()
+		}
+		if err := accumulate(res); err != nil {
+			return err
+		}
+		next, err := cursor(res)
+		if err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+
+		req = r.clone()
+		if _, ok := req.params[param]; !ok {
+			req.paramOrder = append(req.paramOrder, param)
+		}
+		req.params[param] = []string{next}
+	}
+}
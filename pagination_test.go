@@ -0,0 +1,154 @@
+package request
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseLinkHeader(t *testing.T) {
+	links := parseLinkHeader([]string{
+		`<https://api.example.com/items?page=2>; rel="next", <https://api.example.com/items?page=5>; rel="last"`,
+		`</items?page=1>; rel="first prev"`,
+	})
+	want := map[string]string{
+		"next":  "https://api.example.com/items?page=2",
+		"last":  "https://api.example.com/items?page=5",
+		"first": "/items?page=1",
+		"prev":  "/items?page=1",
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("links = %v", links)
+	}
+}
+
+func TestRequest_DoAll(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page < 3 {
+			w.Header().Set("Link", fmt.Sprintf(`</items?page=%d&size=%s>; rel="next"`, page+1, r.URL.Query().Get("size")))
+		}
+		_, _ = w.Write([]byte(strconv.Itoa(page)))
+	}))
+	defer srv.Close()
+
+	var pages []string
+	err := NewRequest(srv.URL, "GET").
+		Prefix("items").
+		Param("size", "10").
+		Header("Authorization", "Bearer token").
+		DoAll(func(res Result) error {
+			body, err := res.Raw()
+			pages = append(pages, string(body))
+			return err
+		})
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if !reflect.DeepEqual(pages, []string{"1", "2", "3"}) {
+		t.Errorf("pages = %v", pages)
+	}
+}
+
+func TestRequest_DoCursor(t *testing.T) {
+	cursors := map[string]string{"": "b", "b": "c", "c": ""}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("cursor")
+		if r.URL.Query().Get("size") != "10" {
+			t.Errorf("size = %q", r.URL.Query().Get("size"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"page": %q, "next_cursor": %q}`, cursor, cursors[cursor])
+	}))
+	defer srv.Close()
+
+	type page struct {
+		Page       string `json:"page"`
+		NextCursor string `json:"next_cursor"`
+	}
+
+	var pages []string
+	err := NewRequest(srv.URL, "GET").
+		Param("size", "10").
+		DoCursor("cursor", func(res Result) (string, error) {
+			var p page
+			err := res.Into(&p)
+			return p.NextCursor, err
+		}, func(res Result) error {
+			var p page
+			if err := res.Into(&p); err != nil {
+				return err
+			}
+			pages = append(pages, p.Page)
+			return nil
+		})
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if !reflect.DeepEqual(pages, []string{"", "b", "c"}) {
+		t.Errorf("pages = %q", pages)
+	}
+}
+
+func TestRequest_NextPageOtherHost(t *testing.T) {
+	var auth, cookie string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, cookie = r.Header.Get("Authorization"), r.Header.Get("Cookie")
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf(`<%s/items?page=2>; rel="next"`, other.URL))
+	}))
+	defer srv.Close()
+
+	var pages int
+	err := NewRequest(srv.URL, "GET").
+		Header("Authorization", "Bearer token").
+		Header("Cookie", "session=abc").
+		Header("Accept", "application/json").
+		DoAll(func(res Result) error {
+			pages++
+			return nil
+		})
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if pages != 2 || auth != "" || cookie != "" {
+		t.Errorf("pages = %d, leaked authorization %q and cookie %q", pages, auth, cookie)
+	}
+}
+
+func TestRequest_DoAllLoop(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Header().Set("Link", fmt.Sprintf(`</items?page=%d>; rel="next"`, (page+1)%3))
+	}))
+	defer srv.Close()
+
+	accumulate := func(Result) error { return nil }
+	if err := NewRequest(srv.URL, "GET").AbsPath("items").Param("page", "0").DoAll(accumulate); err == nil || calls != 3 {
+		t.Errorf("loop: err = %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	endless := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Link", fmt.Sprintf(`</items?page=%d>; rel="next"`, calls))
+	}))
+	defer endless.Close()
+	if err := NewRequest(endless.URL, "GET").MaxPages(5).DoAll(accumulate); err == nil || calls != 5 {
+		t.Errorf("max pages: err = %v after %d calls", err, calls)
+	}
+}
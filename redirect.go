@@ -0,0 +1,51 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// RedirectHop is a redirect response that was followed.
+type RedirectHop struct {
+	URL        string
+	StatusCode int
+}
+
+// redirectChainKey is the context key of the *[]RedirectHop that records the
+// redirects of an attempt.
+type redirectChainKey struct{}
+
+// redirectPolicy is the CheckRedirect of a request's client. It applies the
+// redirect options of the request before deferring to the CheckRedirect of
+// the client it replaced.
+type redirectPolicy struct {
+	next         func(req *http.Request, via []*http.Request) error
+	preserveAuth bool
+	// noDowngrade rejects redirects from https to http.
+	noDowngrade bool
+}
+
+func (p *redirectPolicy) check(req *http.Request, via []*http.Request) error {
+	if hops, ok := req.Context().Value(redirectChainKey{}).(*[]RedirectHop); ok && req.Response != nil {
+		*hops = append(*hops, RedirectHop{
+			URL:        via[len(via)-1].URL.String(),
+			StatusCode: req.Response.StatusCode,
+		})
+	}
+	if prev := via[len(via)-1]; p.noDowngrade && prev.URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing insecure redirect from %s to %s", prev.URL, req.URL)
+	}
+	if p.preserveAuth && req.Header.Get("Authorization") == "" {
+		if auth := via[0].Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+	}
+	if p.next != nil {
+		return p.next(req, via)
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequest_PreserveAuthOnRedirect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer target.Close()
+	// A different hostname for the same address makes the redirect cross-host.
+	other := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	srv := httptest.NewServer(http.RedirectHandler(other, http.StatusFound))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "GET").Header("Authorization", "Bearer token").Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if len(body) != 0 {
+		t.Errorf("authorization leaked without the option: %q", body)
+	}
+
+	body, err = NewRequest(srv.URL, "GET").Header("Authorization", "Bearer token").
+		PreserveAuthOnRedirect(true).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "Bearer token" {
+		t.Errorf("authorization = %q", body)
+	}
+}
+
+func TestResult_RedirectChain(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/a", http.RedirectHandler("/b", http.StatusMovedPermanently))
+	mux.Handle("/b", http.RedirectHandler("/c", http.StatusFound))
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	res := NewRequest(srv.URL, "GET").Prefix("a").Do()
+	if err := res.Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	want := []RedirectHop{
+		{URL: srv.URL + "/a", StatusCode: http.StatusMovedPermanently},
+		{URL: srv.URL + "/b", StatusCode: http.StatusFound},
+	}
+	if got := res.RedirectChain(); !reflect.DeepEqual(got, want) {
+		t.Errorf("chain = %+v, want %+v", got, want)
+	}
+}
+
+func TestRequest_DisallowInsecureRedirect(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	srv := httptest.NewTLSServer(http.RedirectHandler(plain.URL, http.StatusFound))
+	defer srv.Close()
+
+	if err := NewRequest(srv.URL, "GET").Do().Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	err := NewRequest(srv.URL, "GET").DisallowInsecureRedirect().Do().Error()
+	if err == nil || !strings.Contains(err.Error(), "refusing insecure redirect") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRequest_RedirectPolicyBeforeHttpClient(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer plain.Close()
+	srv := httptest.NewTLSServer(http.RedirectHandler(plain.URL, http.StatusFound))
+	defer srv.Close()
+
+	client := srv.Client()
+	err := NewRequest(srv.URL, "GET").DisallowInsecureRedirect().HttpClient(client).Do().Error()
+	if err == nil || !strings.Contains(err.Error(), "refusing insecure redirect") {
+		t.Errorf("err = %v", err)
+	}
+	if client.CheckRedirect != nil {
+		t.Error("the client of the caller was modified")
+	}
+
+	other := strings.Replace(plain.URL, "127.0.0.1", "localhost", 1)
+	cross := httptest.NewServer(http.RedirectHandler(other, http.StatusFound))
+	defer cross.Close()
+	body, err := NewRequest(cross.URL, "GET").Header("Authorization", "Bearer token").
+		PreserveAuthOnRedirect(true).HttpClient(&http.Client{}).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "Bearer token" {
+		t.Errorf("authorization = %q", body)
+	}
+}
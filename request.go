@@ -2,23 +2,38 @@ package request
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"golang.org/x/net/http2"
+	"golang.org/x/sync/singleflight"
 	"gopkg.in/yaml.v2"
 	"io"
 	"io/ioutil"
+	"log"
+	mathrand "math/rand"
 	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -27,8 +42,44 @@ type Decoder interface {
 	Decode(data []byte, mediaType string, into interface{}) (interface{}, error)
 }
 
+// ContextDecoder is a Decoder that can be cancelled. IntoContext uses
+// DecodeContext when the decoder of a result implements it.
+type ContextDecoder interface {
+	Decoder
+	DecodeContext(ctx context.Context, data []byte, mediaType string, into interface{}) (interface{}, error)
+}
+
+// Logger receives diagnostics about retries and endpoint failover.
+// *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, args ...interface{}) {}
+
+// RoundTripFunc sends a single attempt of a request.
+type RoundTripFunc func(*http.Request) (*http.Response, error)
+
+// Middleware wraps the sending of every attempt, retries included.
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
 type Request struct {
 	client *http.Client
+	logger Logger
+
+	// ownTransport is set when client and its transport were created for
+	// this request and may be configured in place.
+	ownTransport bool
+	ownClient    bool
+	// sharedTLS is set while the transport is the one registered for its
+	// TLS configuration.
+	sharedTLS bool
+	// checkRedirect is installed as the CheckRedirect of the client.
+	checkRedirect *redirectPolicy
+	// dialer dials the connections of the transport once it is installed.
+	dialer *connDialer
 
 	verb string
 
@@ -38,16 +89,139 @@ type Request struct {
 	pathPrefix string
 	subpath    string
 	params     url.Values
+	rawQuery   string
 	headers    http.Header
 	timeout    time.Duration
 
+	// rawPath is the escaped form of pathPrefix once Pathf escaped a
+	// segment, e.g. a slash that must not separate segments.
+	rawPath string
+
+	// timeoutParam sends the timeout as a query param as well.
+	timeoutParam bool
+	// methodOverride tunnels verbs other than GET and POST through POST.
+	methodOverride bool
+
+	// paramOrder records param names in the order they were first set, so
+	// that the query can be encoded in insertion order.
+	paramOrder    []string
+	orderedParams bool
+
+	// endpoints are the base urls tried in turn when a connection fails.
+	endpoints      []*url.URL
+	endpointPolicy EndpointPolicy
+
+	// flight coalesces identical in-flight GET requests.
+	flight *singleflight.Group
+
+	// middlewares wrap client.Do, the first one outermost.
+	middlewares []Middleware
+
+	// onUnauthorized refreshes the bearer token after a 401.
+	onUnauthorized func(ctx context.Context) (string, error)
+
+	// signer is called on every attempt once the request is fully built.
+	signer func(*http.Request) error
+	// digest is the algorithm of the ContentDigest header.
+	digest string
+	// observer is called once the request completes.
+	observer ResponseObserver
+	// maxPages bounds DoAll and DoCursor.
+	maxPages int
+	// credentials returns the credentials of every attempt.
+	credentials func(ctx context.Context) (Credentials, error)
+
+	// correlationHeader is set to the context value at correlationKey.
+	correlationHeader string
+	correlationKey    interface{}
+
+	// deadlineHeader is set to the time left until the deadline.
+	deadlineHeader string
+
+	// maxRetryAfter caps the wait between retries requested by the server.
+	maxRetryAfter time.Duration
+
+	// maxSlurpSize bounds how much of a discarded response body is drained
+	// so that its connection can be reused.
+	maxSlurpSize int64
+
+	// useNumber makes Into decode JSON numbers as json.Number.
+	useNumber bool
+	// maxDepth limits the nesting of decoded responses.
+	maxDepth int
+
+	// decoder replaces the built-in decoder of results.
+	decoder Decoder
+
+	// errorStatuses are successful status codes treated as errors.
+	errorStatuses map[int]bool
+	// capErrorBody limits how much of an error body is read.
+	capErrorBody bool
+	// spillOver is the size above which bodies are written to disk.
+	spillOver int64
+	// cache revalidates GET responses by ETag.
+	cache *ETagCache
+
+	// getBody decides whether a GET request may have a body.
+	getBody getBodyPolicy
+
+	// closeConn closes the connection after the response.
+	closeConn bool
+
+	// proxyUser authenticates to the proxy of the transport.
+	proxyUser *url.Userinfo
+
+	// retryDecider replaces checkWait in deciding whether to retry.
+	retryDecider func(resp *http.Response, body []byte) bool
+
+	// trace and collectTimings attach an httptrace.ClientTrace to requests.
+	trace          *httptrace.ClientTrace
+	collectTimings bool
+
+	// tee receives a copy of the response body.
+	tee io.Writer
+
+	// decompress is set when the caller negotiated Accept-Encoding itself,
+	// in which case the transport leaves the response body compressed.
+	decompress bool
+
 	// output
 	err  error
 	body io.Reader
+	// bodyLength is the Content-Length of a body set with BodyReader.
+	bodyLength int64
+	// trailers are sent after the body.
+	trailers http.Header
+	// multipart is turned into the body by prepareBody before sending.
+	multipart []multipartPart
+	// gzipBody compresses bodies larger than gzipThreshold bytes.
+	gzipBody      bool
+	gzipThreshold int
 
 	ctx context.Context
 }
 
+// EndpointPolicy decides which endpoint a request starts with when several
+// are configured with Endpoints.
+type EndpointPolicy int
+
+const (
+	// InOrder always starts with the first endpoint.
+	InOrder EndpointPolicy = iota
+	// RoundRobin rotates the first endpoint across requests.
+	RoundRobin
+)
+
+var roundRobinCounter uint32
+
+// Stats describes how a result was obtained.
+type Stats struct {
+	// Endpoint is the base url that served the response.
+	Endpoint string
+	// Timings are recorded when CollectTimings is set.
+	Timings Timings
+}
+
 type Result struct {
 	body        []byte
 	contentType string
@@ -55,30 +229,201 @@ type Result struct {
 	statusCode  int
 	headers     map[string][]string
 	cookies     []*http.Cookie
+	stats       Stats
+
+	// request and url identify what was sent, e.g. to follow links.
+	request *Request
+	url     *url.URL
+
+	tlsState *tls.ConnectionState
+
+	redirects []RedirectHop
+
+	// spill holds a body written to disk by SpillToDiskOver.
+	spill *spillFile
+
+	// fromCache and coalesced record where the response came from.
+	fromCache bool
+	coalesced bool
+
+	// closer releases what backs a body that is not buffered in memory.
+	closer io.Closer
 
 	decoder Decoder
 }
 
 // Raw returns the raw result.
 func (r Result) Raw() ([]byte, error) {
+	if r.spill != nil {
+		body, err := r.bodyBytes()
+		if err != nil {
+			return nil, err
+		}
+		return body, r.err
+	}
 	return r.body, r.err
 }
 
+// bodyBytes returns the body, reading it from disk when it was spilled.
+func (r Result) bodyBytes() ([]byte, error) {
+	if r.spill == nil {
+		return r.body, nil
+	}
+	return ioutil.ReadAll(r.spill.reader())
+}
+
+// MustRaw is like Raw but panics on error, for scripts and tests.
+func (r Result) MustRaw() []byte {
+	body, err := r.Raw()
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+// MustInto is like Into but panics on error, for scripts and tests.
+func (r Result) MustInto(obj interface{}) {
+	if err := r.Into(obj); err != nil {
+		panic(err)
+	}
+}
+
+// BodyReader returns a new reader over the body on every call, so that the
+// body can be read several times without copying it.
+func (r Result) BodyReader() io.Reader {
+	if r.spill != nil {
+		return r.spill.reader()
+	}
+	return bytes.NewReader(r.body)
+}
+
 func (r Result) Into(obj interface{}) error {
 	if r.err != nil {
 		return r.Error()
 	}
+	return r.decodeInto(obj)
+}
 
-	if len(r.body) == 0 {
+// IntoContext is like Into, but stops decoding when ctx is done if the
+// decoder is a ContextDecoder. Other decoders only observe ctx before they
+// start.
+func (r Result) IntoContext(ctx context.Context, obj interface{}) error {
+	if r.err != nil {
+		return r.Error()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mediaType, _, err := mime.ParseMediaType(r.contentType)
+	if err != nil {
+		return err
+	}
+	dec, ok := r.decoder.(ContextDecoder)
+	if !ok {
+		return r.decodeAs(obj, mediaType)
+	}
+	body, err := r.bodyBytes()
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
 		return fmt.Errorf("0-length response")
 	}
+	_, err = dec.DecodeContext(ctx, body, mediaType, &obj)
+	return err
+}
+
+// IntoStream decodes a body of concatenated JSON values, such as
+// newline-delimited JSON, into the slice slicePtr points to, appending one
+// element per value.
+func (r Result) IntoStream(slicePtr interface{}) error {
+	if r.err != nil {
+		return r.Error()
+	}
+	v := reflect.ValueOf(slicePtr)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("IntoStream needs a pointer to a slice, got %T", slicePtr)
+	}
+	slice := v.Elem()
+	dec := json.NewDecoder(r.BodyReader())
+	if d, ok := r.decoder.(*decode); ok && d.useNumber {
+		dec.UseNumber()
+	}
+	for {
+		elem := reflect.New(slice.Type().Elem())
+		if err := dec.Decode(elem.Interface()); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+}
+
+// IntoError decodes the body of an unsuccessful response into target, a
+// pointer to the caller's error type, and returns it. It returns nil when the
+// request succeeded and the original error when the body cannot be decoded
+// into target.
+func (r Result) IntoError(target error) error {
+	if r.err == nil {
+		return nil
+	}
+	if r.statusCode == 0 || r.IsSuccess() || target == nil {
+		return r.Error()
+	}
+	if err := r.decodeInto(target); err != nil {
+		return r.Error()
+	}
+	return target
+}
+
+// Validate runs fn over the body of a successful result, e.g. to verify a
+// checksum or signature, and returns the result with the error of fn, so
+// that it can be chained before Into.
+func (r Result) Validate(fn func(body []byte) error) Result {
+	if r.err != nil {
+		return r
+	}
+	body, err := r.bodyBytes()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.err = fn(body)
+	return r
+}
 
+func (r Result) decodeInto(obj interface{}) error {
 	mediaType, _, err := mime.ParseMediaType(r.contentType)
 	if err != nil {
 		return err
 	}
+	return r.decodeAs(obj, mediaType)
+}
+
+// DecodeAs decodes the body into obj as mediaType, ignoring the Content-Type
+// of the response, e.g. for servers that omit it or send the wrong one.
+func (r Result) DecodeAs(obj interface{}, mediaType string) error {
+	if r.err != nil {
+		return r.Error()
+	}
+	return r.decodeAs(obj, mediaType)
+}
+
+func (r Result) decodeAs(obj interface{}, mediaType string) error {
+	if r.decoder == nil {
+		return fmt.Errorf("no decoder for the response")
+	}
+
+	body, err := r.bodyBytes()
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return fmt.Errorf("0-length response")
+	}
 
-	out, err := r.decoder.Decode(r.body, mediaType, &obj)
+	out, err := r.decoder.Decode(body, mediaType, &obj)
 	if err != nil || out == obj {
 		return err
 	}
@@ -113,6 +458,110 @@ func (r Result) Cookies() []*http.Cookie {
 	return r.cookies
 }
 
+// Cookie returns the response cookie with the given name.
+func (r Result) Cookie(name string) (*http.Cookie, bool) {
+	for _, cookie := range r.cookies {
+		if cookie.Name == name {
+			return cookie, true
+		}
+	}
+	return nil, false
+}
+
+// Header returns the first value of the response header with the given
+// name, or "" when it is absent.
+func (r Result) Header(name string) string {
+	return http.Header(r.headers).Get(name)
+}
+
+var _ io.WriterTo = Result{}
+
+// WriteTo writes the response body to w. It returns the number of bytes
+// written and the write error, or else the error of the result.
+func (r Result) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, r.BodyReader())
+	if err != nil {
+		return n, err
+	}
+	return n, r.err
+}
+
+// IsSuccess reports whether the server responded with a 2xx status code.
+func (r Result) IsSuccess() bool {
+	return r.statusCode >= 200 && r.statusCode < 300
+}
+
+// IsClientError reports whether the server responded with a 4xx status code.
+func (r Result) IsClientError() bool {
+	return r.statusCode >= 400 && r.statusCode < 500
+}
+
+// IsServerError reports whether the server responded with a 5xx status code.
+func (r Result) IsServerError() bool {
+	return r.statusCode >= 500 && r.statusCode < 600
+}
+
+// Close releases the resources held by the result. It is a no-op for bodies
+// buffered in memory, and safe to call more than once.
+func (r Result) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// onceCloser closes an io.Closer on the first call to Close only, so that
+// copies of a Result can all be closed.
+type onceCloser struct {
+	once   sync.Once
+	closer io.Closer
+	err    error
+}
+
+func (c *onceCloser) Close() error {
+	c.once.Do(func() {
+		c.err = c.closer.Close()
+	})
+	return c.err
+}
+
+// TLSState returns the TLS connection state negotiated for the response,
+// such as the version, cipher suite and peer certificates, or nil for plain
+// HTTP.
+func (r Result) TLSState() *tls.ConnectionState {
+	return r.tlsState
+}
+
+// RetryAfter returns how long the server asked to wait before retrying, as
+// sent in the Retry-After header with a 429 or 503, either in seconds or as
+// a date.
+func (r Result) RetryAfter() (time.Duration, bool) {
+	return parseRetryAfter(http.Header(r.headers).Get("Retry-After"))
+}
+
+// FromCache reports whether the response was served from an ETagCache
+// after the server replied 304 Not Modified.
+func (r Result) FromCache() bool {
+	return r.fromCache
+}
+
+// Coalesced reports whether the Result was shared by concurrent requests
+// through SingleFlight.
+func (r Result) Coalesced() bool {
+	return r.coalesced
+}
+
+// RedirectChain returns the redirects that were followed to obtain the
+// result, in order.
+func (r Result) RedirectChain() []RedirectHop {
+	return r.redirects
+}
+
+// Stats returns details about how the result was obtained.
+func (r Result) Stats() Stats {
+	return r.stats
+}
+
 // StatusCode returns the HTTP status code of the request. (Only valid if no
 // error was returned.)
 func (r Result) StatusCode(statusCode *int) Result {
@@ -121,267 +570,1818 @@ func (r Result) StatusCode(statusCode *int) Result {
 }
 
 func NewRequest(baseUrl, verb string) *Request {
-	dialer := &net.Dialer{
-		Timeout:   time.Duration(30 * time.Second),
-		KeepAlive: time.Duration(30 * time.Second),
-	}
-
-	var isHttps bool
-	if strings.Index(baseUrl, "https") != -1 {
-		isHttps = true
-	}
-
-	hostURL, err := url.Parse(baseUrl)
-	if err != nil || hostURL.Scheme == "" || hostURL.Host == "" {
-		scheme := "http://"
-		if isHttps {
-			scheme = "https://"
-		}
-		hostURL, _ = url.Parse(scheme + baseUrl)
-	}
+	hostURL, err := parseBaseURL(baseUrl)
+	isHttps := hostURL != nil && hostURL.Scheme == "https"
+	skipVerify := isHttps && !tlsVerifyForced()
 
 	pathPrefix := "/"
 	if hostURL != nil {
 		pathPrefix = path.Join(pathPrefix, hostURL.Path)
 	}
 
+	transport, _ := sharedTransport(&tls.Config{
+		InsecureSkipVerify: skipVerify,
+		ClientSessionCache: defaultSessionCache,
+	})
+
 	return &Request{
-		headers: nil,
-		baseURL: hostURL,
-		client: &http.Client{
-			Transport: &http.Transport{
-				DialContext: dialer.DialContext,
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: isHttps,
-				},
-			},
-		},
+		headers:    nil,
+		baseURL:    hostURL,
+		client:     &http.Client{Transport: transport},
+		ownClient:  true,
+		sharedTLS:  true,
 		verb:       strings.ToUpper(verb),
 		pathPrefix: pathPrefix,
+		logger:     nopLogger{},
+		err:        err,
 	}
 }
 
-func (r *Request) HttpClient(client *http.Client) *Request {
-	r.client = client
-	return r
-}
-
-func (r *Request) Header(key string, values ...string) *Request {
-	if r.headers == nil {
-		r.headers = http.Header{}
+// FromHTTPRequest returns a Request with the method, URL, headers, body and
+// context of req, e.g. to replay a captured request. The body is taken from
+// req.GetBody when set, so that req can still be sent itself; otherwise
+// req.Body is consumed by the Request. An incoming server request, whose
+// URL has no scheme and host, is sent to req.Host.
+func FromHTTPRequest(req *http.Request) *Request {
+	scheme, host := req.URL.Scheme, req.URL.Host
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
 	}
-	r.headers.Del(key)
-	for _, value := range values {
-		r.headers.Add(key, value)
+	if host == "" {
+		host = req.Host
+	}
+	r := NewRequest(scheme+"://"+host, req.Method)
+	r.pathPrefix, r.rawPath = req.URL.Path, req.URL.RawPath
+	if r.pathPrefix == "" {
+		r.pathPrefix = "/"
+	}
+	r.ParamsFromURL(req.URL)
+	r.headers = cloneHeader(req.Header)
+	r.ctx = req.Context()
+
+	body := req.Body
+	if req.GetBody != nil {
+		var err error
+		if body, err = req.GetBody(); err != nil {
+			r.err = err
+			return r
+		}
+	}
+	if body != nil && body != http.NoBody {
+		r.body = body
+		if req.ContentLength > 0 {
+			r.bodyLength = req.ContentLength
+		}
 	}
 	return r
 }
 
-func (r *Request) Timeout(d time.Duration) *Request {
-	if r.err != nil {
-		return r
-	}
-	r.timeout = d
-	return r
+// ForceTLSVerify makes NewRequest verify the certificates of HTTPS servers,
+// which it skips by default. Setting the environment variable
+// REQUEST_TLS_VERIFY=1 has the same effect without a code change.
+var ForceTLSVerify = false
+
+func tlsVerifyForced() bool {
+	return ForceTLSVerify || os.Getenv("REQUEST_TLS_VERIFY") == "1"
 }
 
-func (r *Request) Context(ctx context.Context) *Request {
-	r.ctx = ctx
-	return r
+// defaultSessionCache is shared by the transports created by NewRequest so
+// that repeated HTTPS calls to the same host resume their TLS sessions.
+var defaultSessionCache = tls.NewLRUClientSessionCache(0)
+
+// clone returns a copy of the request that shares its client but not its
+// params, headers or body.
+func (r *Request) clone() *Request {
+	c := *r
+	c.headers = cloneHeader(r.headers)
+	c.params = make(url.Values, len(r.params))
+	for k, v := range r.params {
+		c.params[k] = append([]string(nil), v...)
+	}
+	c.paramOrder = append([]string(nil), r.paramOrder...)
+	c.body = nil
+	return &c
 }
 
-func (r *Request) Prefix(segments ...string) *Request {
+// AbsoluteURL points the request at a complete url, replacing its scheme,
+// host, path and params while keeping the client, headers and options. Unlike
+// AbsPath, which only replaces the path, it can move the request to another
+// host, e.g. to follow a url returned by the server.
+func (r *Request) AbsoluteURL(rawurl string) *Request {
 	if r.err != nil {
 		return r
 	}
-	r.pathPrefix = path.Join(r.pathPrefix, path.Join(segments...))
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if !u.IsAbs() || u.Host == "" {
+		r.err = fmt.Errorf("%q is not an absolute url", rawurl)
+		return r
+	}
+	r.setAbsoluteURL(u)
 	return r
 }
 
-func (r *Request) Suffix(segments ...string) *Request {
-	if r.err != nil {
-		return r
+// setAbsoluteURL points the request at u, replacing its host, path and
+// query.
+func (r *Request) setAbsoluteURL(u *url.URL) {
+	base := *u
+	base.Path, base.RawPath, base.RawQuery, base.Fragment = "", "", "", ""
+	r.baseURL = &base
+	r.endpoints = nil
+	r.pathPrefix, r.rawPath = u.Path, u.RawPath
+	if r.pathPrefix == "" {
+		r.pathPrefix = "/"
+	}
+	r.rawQuery = ""
+	r.params = make(url.Values)
+	r.paramOrder = nil
+	for _, k := range queryKeys(u.RawQuery) {
+		r.paramOrder = append(r.paramOrder, k)
+	}
+	for k, v := range u.Query() {
+		r.params[k] = v
 	}
-	r.subpath = path.Join(r.subpath, path.Join(segments...))
-	return r
 }
 
-func (r *Request) AbsPath(segments ...string) *Request {
-	if r.err != nil {
-		return r
+// parseBaseURL parses a base url, defaulting the scheme to http when it is
+// missing, e.g. for "example.com/api" or "[::1]:8443".
+func parseBaseURL(baseUrl string) (*url.URL, error) {
+	hostURL, err := url.Parse(baseUrl)
+	if err == nil && hostURL.Scheme != "" && hostURL.Host != "" {
+		return hostURL, nil
 	}
-	r.pathPrefix = path.Join(r.baseURL.Path, path.Join(segments...))
-	if len(segments) == 1 && (len(r.baseURL.Path) > 1 || len(segments[0]) > 1) && strings.HasSuffix(segments[0], "/") {
-		// preserve any trailing slashes for legacy behavior
-		r.pathPrefix += "/"
+	if strings.Contains(baseUrl, "://") {
+		if err == nil {
+			err = fmt.Errorf("invalid base url %q: missing host", baseUrl)
+		}
+		return nil, err
 	}
-	return r
+	return url.Parse("http://" + baseUrl)
 }
 
-func (r *Request) RequestURI(uri string) *Request {
+// BaseURL replaces the scheme and host the request is sent to, keeping the
+// path segments, params and headers that were already set.
+func (r *Request) BaseURL(baseUrl string) *Request {
 	if r.err != nil {
 		return r
 	}
-	locator, err := url.Parse(uri)
+	hostURL, err := parseBaseURL(baseUrl)
 	if err != nil {
 		r.err = err
 		return r
 	}
-	r.pathPrefix = locator.Path
-	if len(locator.Query()) > 0 {
-		if r.params == nil {
-			r.params = make(url.Values)
-		}
-		for k, v := range locator.Query() {
-			r.params[k] = v
-		}
-	}
+	r.rebase(hostURL)
 	return r
 }
 
-func (r *Request) Param(paramName, s string) *Request {
+// Endpoints sets the base urls of the request. When a connection to one of
+// them fails, the request is sent to the next one; the endpoint that served
+// the response is reported in Result.Stats.
+func (r *Request) Endpoints(urls ...string) *Request {
 	if r.err != nil {
 		return r
 	}
-	return r.setParam(paramName, s)
+	endpoints := make([]*url.URL, 0, len(urls))
+	for _, u := range urls {
+		hostURL, err := parseBaseURL(u)
+		if err != nil {
+			r.err = err
+			return r
+		}
+		endpoints = append(endpoints, hostURL)
+	}
+	r.endpoints = endpoints
+	if len(endpoints) > 0 {
+		r.rebase(endpoints[0])
+	}
+	return r
 }
 
-func (r *Request) setParam(paramName, value string) *Request {
-	if r.params == nil {
-		r.params = make(url.Values)
-	}
-	r.params[paramName] = append(r.params[paramName], value)
+// EndpointPolicy sets which of the Endpoints a request starts with.
+func (r *Request) EndpointPolicy(policy EndpointPolicy) *Request {
+	r.endpointPolicy = policy
 	return r
 }
 
-func (r *Request) Body(obj interface{}) *Request {
-	if r.err != nil {
-		return r
+// rebase replaces the base url, keeping the path appended to the old one.
+func (r *Request) rebase(hostURL *url.URL) {
+	oldPrefix := "/"
+	if r.baseURL != nil {
+		oldPrefix = path.Join(oldPrefix, r.baseURL.Path)
 	}
-	switch t := obj.(type) {
-	case string:
-		data, err := ioutil.ReadFile(t)
-		if err != nil {
-			r.err = err
-			return r
-		}
-		r.body = bytes.NewReader(data)
-	case []byte:
-		r.body = bytes.NewReader(t)
-	case io.Reader:
-		r.body = t
+	if r.rawPath != "" {
+		r.rawPath = rebasePath(r.escapedPath(), escapePath(oldPrefix), escapePath(hostURL.Path))
+	}
+	r.baseURL = hostURL
+	r.pathPrefix = rebasePath(r.pathPrefix, oldPrefix, hostURL.Path)
+}
+
+// rebasePath moves p from under oldPrefix to under newPrefix.
+func rebasePath(p, oldPrefix, newPrefix string) string {
+	relPath := p
+	if strings.HasPrefix(relPath, oldPrefix) {
+		relPath = strings.TrimPrefix(relPath, oldPrefix)
+	}
+	newPath := path.Join("/", newPrefix, relPath)
+	if strings.HasSuffix(relPath, "/") && !strings.HasSuffix(newPath, "/") {
+		newPath += "/"
+	}
+	return newPath
+}
+
+// escapePath escapes p the way it is sent when no segment needs Pathf.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// escapedPath returns the escaped form of the path, keeping the segments
+// escaped by Pathf.
+func (r *Request) escapedPath() string {
+	if r.rawPath != "" {
+		if p, err := url.PathUnescape(r.rawPath); err == nil && p == r.pathPrefix {
+			return r.rawPath
+		}
+	}
+	return escapePath(r.pathPrefix)
+}
+
+func (r *Request) HttpClient(client *http.Client) *Request {
+	r.client = client
+	r.ownClient = false
+	r.ownTransport = false
+	r.sharedTLS = false
+	return r
+}
+
+// httpClient returns the *http.Client used by the request so that it can be
+// configured. A client set with HttpClient is copied first so that shared
+// clients are never modified.
+func (r *Request) httpClient() *http.Client {
+	if r.ownClient && r.client != nil {
+		return r.client
+	}
+	client := &http.Client{}
+	if r.client != nil {
+		*client = *r.client
+	}
+	r.client = client
+	r.ownClient = true
+	if r.checkRedirect != nil {
+		r.checkRedirect.next = client.CheckRedirect
+		client.CheckRedirect = r.checkRedirect.check
+	}
+	return client
+}
+
+// transport returns the *http.Transport used by the request so that it can be
+// configured. A client set with HttpClient is copied first so that shared
+// clients and transports are never modified.
+func (r *Request) transport() (*http.Transport, error) {
+	client := r.httpClient()
+	if r.ownTransport {
+		if t, ok := client.Transport.(*http.Transport); ok {
+			return t, nil
+		}
+	}
+
+	var t *http.Transport
+	switch rt := client.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return nil, fmt.Errorf("cannot configure transport of type %T", rt)
+	}
+	client.Transport = t
+	r.ownTransport = true
+	r.sharedTLS = false
+	return t, nil
+}
+
+// redirectPolicy returns the redirect policy of the request, installing it
+// on the client the first time. httpClient re-installs it on a copy of a
+// client set later with HttpClient.
+func (r *Request) redirectPolicy() *redirectPolicy {
+	client := r.httpClient()
+	if r.checkRedirect == nil {
+		r.checkRedirect = &redirectPolicy{next: client.CheckRedirect}
+		client.CheckRedirect = r.checkRedirect.check
+	}
+	return r.checkRedirect
+}
+
+// PreserveAuthOnRedirect keeps the Authorization header when following a
+// redirect to another host, which Go strips by default. Only enable it for
+// trusted redirects.
+func (r *Request) PreserveAuthOnRedirect(preserve bool) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.redirectPolicy().preserveAuth = preserve
+	return r
+}
+
+// DisallowInsecureRedirect makes a redirect from https to http fail the
+// request instead of silently downgrading it.
+func (r *Request) DisallowInsecureRedirect() *Request {
+	if r.err != nil {
+		return r
+	}
+	r.redirectPolicy().noDowngrade = true
+	return r
+}
+
+// tlsConfig returns the TLS configuration of the request's transport,
+// creating it when it is not set.
+func (r *Request) tlsConfig() (*tls.Config, error) {
+	t, err := r.transport()
+	if err != nil {
+		return nil, err
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	return t.TLSClientConfig, nil
+}
+
+// MaxConnsPerHost limits the connections the transport of the request opens
+// to a host, including those dialing and in use; requests over the limit
+// wait for a connection. A shared transport is copied first, so to throttle
+// several requests, configure one and share its client with HttpClient.
+func (r *Request) MaxConnsPerHost(n int) *Request {
+	if r.err != nil {
+		return r
+	}
+	t, err := r.transport()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	t.MaxConnsPerHost = n
+	return r
+}
+
+// MaxResponseHeaderBytes limits the size of the response headers, protecting
+// memory against servers that flood headers.
+func (r *Request) MaxResponseHeaderBytes(n int64) *Request {
+	if r.err != nil {
+		return r
+	}
+	t, err := r.transport()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	t.MaxResponseHeaderBytes = n
+	return r
+}
+
+// connDialer returns the dialer of the request, installing it on the
+// transport if the transport dials with something else.
+func (r *Request) connDialer() (*connDialer, error) {
+	t, err := r.transport()
+	if err != nil {
+		return nil, err
+	}
+	if r.dialer == nil {
+		r.dialer = newConnDialer()
+	}
+	t.DialContext = r.dialer.DialContext
+	return r.dialer, nil
+}
+
+// KeepAlivePeriod sets the interval of TCP keep-alive probes on new
+// connections; zero or a negative period disables keep-alive. The default is
+// 30 seconds.
+func (r *Request) KeepAlivePeriod(d time.Duration) *Request {
+	if r.err != nil {
+		return r
+	}
+	dialer, err := r.connDialer()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if d <= 0 {
+		// a zero KeepAlive would enable the net package default.
+		d = -1
+	}
+	dialer.KeepAlive = d
+	return r
+}
+
+// Proxy sends the request through the proxy at rawurl, e.g.
+// "http://proxy:3128". HTTPS requests tunnel through it with CONNECT.
+func (r *Request) Proxy(rawurl string) *Request {
+	if r.err != nil {
+		return r
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	t, err := r.transport()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	t.Proxy = proxyWithUser(http.ProxyURL(u), r.proxyUser)
+	return r
+}
+
+// ProxyAuth authenticates to the proxy with basic auth, both in the CONNECT
+// request of HTTPS tunnels and in plain HTTP requests, which the proxy sees
+// in full. The credentials are only sent to a proxy, the one set with Proxy
+// or else the one of the environment, never to a host reached directly.
+func (r *Request) ProxyAuth(user, pass string) *Request {
+	if r.err != nil {
+		return r
+	}
+	t, err := r.transport()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.proxyUser = url.UserPassword(user, pass)
+	t.Proxy = proxyWithUser(t.Proxy, r.proxyUser)
+	return r
+}
+
+// proxyWithUser adds user to the proxy urls returned by proxy, from which
+// the transport sets Proxy-Authorization on the requests it proxies.
+func proxyWithUser(proxy func(*http.Request) (*url.URL, error), user *url.Userinfo) func(*http.Request) (*url.URL, error) {
+	if proxy == nil || user == nil {
+		return proxy
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if u == nil || err != nil {
+			return u, err
+		}
+		withUser := *u
+		withUser.User = user
+		return &withUser, nil
+	}
+}
+
+// DialAddr connects to addr, a host:port, whatever the host of the URL is,
+// e.g. to test a specific CDN edge. The URL, Host header and TLS server name
+// keep the host of the URL.
+func (r *Request) DialAddr(addr string) *Request {
+	if r.err != nil {
+		return r
+	}
+	dialer, err := r.connDialer()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	dialer.addr = addr
+	return r
+}
+
+// ReadTimeout sets how long a read on the connection may block. The deadline
+// is reset before every read, guarding against servers that trickle bytes.
+func (r *Request) ReadTimeout(d time.Duration) *Request {
+	if r.err != nil {
+		return r
+	}
+	dialer, err := r.connDialer()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	dialer.readTimeout = d
+	return r
+}
+
+// WriteTimeout sets how long a write on the connection may block. The
+// deadline is reset before every write.
+func (r *Request) WriteTimeout(d time.Duration) *Request {
+	if r.err != nil {
+		return r
+	}
+	dialer, err := r.connDialer()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	dialer.writeTimeout = d
+	return r
+}
+
+// TLSSessionCache sets the cache used to resume TLS sessions. By default the
+// requests created by NewRequest share one LRU cache.
+func (r *Request) TLSSessionCache(cache tls.ClientSessionCache) *Request {
+	if r.err != nil {
+		return r
+	}
+	if err := r.configureTLS(func(config *tls.Config) {
+		config.ClientSessionCache = cache
+	}); err != nil {
+		r.err = err
+	}
+	return r
+}
+
+// TLSVersion sets the minimum and maximum TLS versions, e.g. tls.VersionTLS12.
+// A zero value leaves the corresponding bound at its default. Other TLS
+// settings of the transport are kept.
+func (r *Request) TLSVersion(min, max uint16) *Request {
+	if r.err != nil {
+		return r
+	}
+	if min != 0 && max != 0 && min > max {
+		r.err = fmt.Errorf("invalid TLS version range: min %#x is above max %#x", min, max)
+		return r
+	}
+	if err := r.configureTLS(func(config *tls.Config) {
+		config.MinVersion = min
+		config.MaxVersion = max
+	}); err != nil {
+		r.err = err
+	}
+	return r
+}
+
+// TLSServerName sets the name sent for SNI and used to verify the server's
+// certificate, e.g. when connecting to a backend by IP.
+func (r *Request) TLSServerName(name string) *Request {
+	if r.err != nil {
+		return r
+	}
+	if err := r.configureTLS(func(config *tls.Config) {
+		config.ServerName = name
+	}); err != nil {
+		r.err = err
+	}
+	return r
+}
+
+// WithLogger sets the logger used to report retry decisions and endpoint
+// failover. A nil logger discards the messages.
+func (r *Request) WithLogger(l Logger) *Request {
+	if l == nil {
+		l = nopLogger{}
+	}
+	r.logger = l
+	return r
+}
+
+// Decoder sets the decoder used by Into and IntoContext instead of the
+// built-in one, which decodes with the registered unmarshalers. UseNumber
+// and MaxDecodeDepth only apply to the built-in decoder.
+func (r *Request) Decoder(d Decoder) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.decoder = d
+	return r
+}
+
+func (r *Request) logf(format string, args ...interface{}) {
+	if r.logger != nil {
+		r.logger.Printf(format, args...)
+	}
+}
+
+func (r *Request) Header(key string, values ...string) *Request {
+	if r.headers == nil {
+		r.headers = http.Header{}
+	}
+	r.headers.Del(key)
+	for _, value := range values {
+		r.headers.Add(key, value)
+	}
+	return r
+}
+
+// Trailer sets a trailer that is sent after the body, which is then sent
+// chunked. Trailers require a body.
+func (r *Request) Trailer(key string, values ...string) *Request {
+	if r.err != nil {
+		return r
+	}
+	if r.trailers == nil {
+		r.trailers = http.Header{}
+	}
+	r.trailers.Del(key)
+	for _, value := range values {
+		r.trailers.Add(key, value)
+	}
+	return r
+}
+
+// ResetHeaders removes the headers set so far.
+func (r *Request) ResetHeaders() *Request {
+	r.headers = nil
+	return r
+}
+
+// Cookie adds a cookie to the Cookie header of the request.
+func (r *Request) Cookie(c *http.Cookie) *Request {
+	return r.Cookies(c)
+}
+
+// Cookies adds cookies to the Cookie header of the request. Only their names
+// and values are sent.
+func (r *Request) Cookies(cs ...*http.Cookie) *Request {
+	if len(cs) == 0 {
+		return r
+	}
+	req := &http.Request{Header: http.Header{}}
+	if cookie := r.headers.Get("Cookie"); cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	for _, c := range cs {
+		req.AddCookie(c)
+	}
+	return r.Header("Cookie", req.Header.Get("Cookie"))
+}
+
+// AcceptEncoding sets the Accept-Encoding header and makes the response body
+// decoded according to its Content-Encoding (gzip and deflate are supported).
+//
+// Go's transport only requests and transparently decompresses gzip when the
+// caller did not set Accept-Encoding; once the header is set explicitly, the
+// raw compressed bytes are handed back. The body is then decoded here
+// instead, also when the header was set with Header, so that Raw and Into
+// always see the decoded body.
+func (r *Request) AcceptEncoding(enc ...string) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.decompress = true
+	return r.Header("Accept-Encoding", strings.Join(enc, ", "))
+}
+
+// AcceptLanguage sets the Accept-Language header to langs, in order of
+// preference, e.g. AcceptLanguage("de-CH", "de;q=0.9", "en;q=0.8").
+func (r *Request) AcceptLanguage(langs ...string) *Request {
+	if r.err != nil {
+		return r
+	}
+	return r.Header("Accept-Language", strings.Join(langs, ", "))
+}
+
+// IfMatch sets the If-Match header so that the server only applies the
+// request while the resource still has the given ETag. A mismatch fails with
+// an error for which IsPreconditionFailed is true.
+func (r *Request) IfMatch(etag string) *Request {
+	if r.err != nil {
+		return r
+	}
+	return r.Header("If-Match", etag)
+}
+
+// IfNoneMatch sets the If-None-Match header, e.g. to "*" so that a PUT only
+// creates a resource that does not exist yet.
+func (r *Request) IfNoneMatch(etag string) *Request {
+	if r.err != nil {
+		return r
+	}
+	return r.Header("If-None-Match", etag)
+}
+
+// ContentLanguage sets the Content-Language header to the languages of the
+// body.
+func (r *Request) ContentLanguage(langs ...string) *Request {
+	if r.err != nil {
+		return r
+	}
+	return r.Header("Content-Language", strings.Join(langs, ", "))
+}
+
+// Timeout bounds the whole request, retries included, by a context deadline.
+// When the context set with Context has a deadline too, whichever is sooner
+// wins. The timeout is only sent to the server as a timeout query param when
+// TimeoutQueryParam is set too.
+func (r *Request) Timeout(d time.Duration) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.timeout = d
+	return r
+}
+
+// TimeoutQueryParam sends the timeout set with Timeout as the timeout query
+// param, for servers that bound their own processing by it.
+func (r *Request) TimeoutQueryParam() *Request {
+	if r.err != nil {
+		return r
+	}
+	r.timeoutParam = true
+	return r
+}
+
+// requestContext returns the context requests are sent with. When both the
+// context of the request has a deadline and a timeout is set, the sooner of
+// the two applies.
+func (r *Request) requestContext() (context.Context, context.CancelFunc) {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = r.correlate(ctx)
+	if r.timeout <= 0 {
+		return ctx, func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= r.timeout {
+		// the context expires first and already bounds the request.
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.timeout)
+}
+
+func (r *Request) Context(ctx context.Context) *Request {
+	r.ctx = ctx
+	return r
+}
+
+// CorrelationHeader sets the header name to the value stored in the context
+// of the request under ctxKey, e.g. a request ID passed down from an
+// incoming request. Without such a value a random ID is generated, which
+// every retry of the request shares. Like for context.WithValue, ctxKey must
+// be non-nil and comparable.
+func (r *Request) CorrelationHeader(name string, ctxKey interface{}) *Request {
+	if r.err != nil {
+		return r
+	}
+	if ctxKey == nil || !reflect.TypeOf(ctxKey).Comparable() {
+		r.err = fmt.Errorf("CorrelationHeader: %T is not a valid context key", ctxKey)
+		return r
+	}
+	r.correlationHeader = name
+	r.correlationKey = ctxKey
+	return r
+}
+
+// PropagateDeadlineHeader sets the header name on every attempt to the
+// milliseconds left until the deadline of the request, from its context or
+// Timeout, so that the server can give up when the client will.
+func (r *Request) PropagateDeadlineHeader(name string) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.deadlineHeader = name
+	return r
+}
+
+// correlate stores a generated correlation ID in ctx unless it holds one.
+func (r *Request) correlate(ctx context.Context) context.Context {
+	if r.correlationHeader == "" || ctx.Value(r.correlationKey) != nil {
+		return ctx
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, r.correlationKey, hex.EncodeToString(id))
+}
+
+// setCorrelationHeader copies the correlation ID of ctx into h.
+func (r *Request) setCorrelationHeader(ctx context.Context, h http.Header) {
+	if r.correlationHeader == "" {
+		return
+	}
+	if id := ctx.Value(r.correlationKey); id != nil {
+		h.Set(r.correlationHeader, fmt.Sprint(id))
+	}
+}
+
+func (r *Request) Prefix(segments ...string) *Request {
+	if r.err != nil {
+		return r
+	}
+	if r.rawPath != "" {
+		r.rawPath = path.Join(r.escapedPath(), escapePath(path.Join(segments...)))
+	}
+	r.pathPrefix = path.Join(r.pathPrefix, path.Join(segments...))
+	return r
+}
+
+func (r *Request) Suffix(segments ...string) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.subpath = path.Join(r.subpath, path.Join(segments...))
+	return r
+}
+
+// Pathf appends a path formatted like fmt.Sprintf, e.g.
+// Pathf("/users/%d/posts/%s", id, slug). String arguments are path escaped,
+// so that an argument always stays a single segment; "." and ".." are
+// rejected since they would not.
+func (r *Request) Pathf(format string, args ...interface{}) *Request {
+	if r.err != nil {
+		return r
+	}
+	escaped := make([]interface{}, len(args))
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if stringer, isStringer := arg.(fmt.Stringer); !ok && isStringer {
+			s, ok = stringer.String(), true
+		}
+		if !ok {
+			escaped[i] = arg
+			continue
+		}
+		if s == "." || s == ".." {
+			r.err = fmt.Errorf("Pathf: %q is not a valid path segment", s)
+			return r
+		}
+		escaped[i] = url.PathEscape(s)
+	}
+	rawPath := path.Join(r.escapedPath(), fmt.Sprintf(format, escaped...))
+	unescaped, err := url.PathUnescape(rawPath)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.pathPrefix, r.rawPath = unescaped, rawPath
+	return r
+}
+
+func (r *Request) AbsPath(segments ...string) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.rawPath = ""
+	r.pathPrefix = path.Join(r.baseURL.Path, path.Join(segments...))
+	if len(segments) == 1 && (len(r.baseURL.Path) > 1 || len(segments[0]) > 1) && strings.HasSuffix(segments[0], "/") {
+		// preserve any trailing slashes for legacy behavior
+		r.pathPrefix += "/"
+	}
+	return r
+}
+
+// RequestURI sets the path of the request to the path of uri, replacing any
+// prefix, and adds its query parameters like ParamsFromURL, keeping the
+// values already set for the same keys.
+func (r *Request) RequestURI(uri string) *Request {
+	if r.err != nil {
+		return r
+	}
+	locator, err := url.Parse(uri)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.pathPrefix, r.rawPath = locator.Path, locator.RawPath
+	return r.ParamsFromURL(locator)
+}
+
+// ParamsFromURL adds the query parameters of u to the request, keeping the
+// values already set for the same keys.
+func (r *Request) ParamsFromURL(u *url.URL) *Request {
+	if r.err != nil {
+		return r
+	}
+	query := u.Query()
+	for _, k := range queryKeys(u.RawQuery) {
+		for _, v := range query[k] {
+			r.setParam(k, v)
+		}
+	}
+	return r
+}
+
+// queryKeys returns the distinct keys of a raw query in order of appearance.
+func queryKeys(rawQuery string) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, pair := range strings.FieldsFunc(rawQuery, func(c rune) bool { return c == '&' || c == ';' }) {
+		key := pair
+		if i := strings.Index(key, "="); i >= 0 {
+			key = key[:i]
+		}
+		key, err := url.QueryUnescape(key)
+		if err != nil || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (r *Request) Param(paramName, s string) *Request {
+	if r.err != nil {
+		return r
+	}
+	return r.setParam(paramName, s)
+}
+
+// ResetParams removes the params and raw query set so far, e.g. to reuse the
+// request in a loop.
+func (r *Request) ResetParams() *Request {
+	r.params = nil
+	r.paramOrder = nil
+	r.rawQuery = ""
+	return r
+}
+
+// RawQuery sets the query string verbatim, without the re-ordering and
+// escaping done for params. It is mutually exclusive with Param: once a raw
+// query is set, params are not sent.
+func (r *Request) RawQuery(q string) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.rawQuery = strings.TrimPrefix(q, "?")
+	return r
+}
+
+// OrderedParams encodes params in the order they were first set instead of
+// sorting them by name, as required by some query signing schemes.
+func (r *Request) OrderedParams() *Request {
+	r.orderedParams = true
+	return r
+}
+
+func (r *Request) setParam(paramName, value string) *Request {
+	if r.params == nil {
+		r.params = make(url.Values)
+	}
+	if _, ok := r.params[paramName]; !ok {
+		r.paramOrder = append(r.paramOrder, paramName)
+	}
+	r.params[paramName] = append(r.params[paramName], value)
+	return r
+}
+
+// encodeOrdered encodes values like url.Values.Encode, but in the order of
+// keys rather than sorted. Keys missing from the order are appended sorted.
+func encodeOrdered(values url.Values, keys []string) string {
+	var buf strings.Builder
+	seen := map[string]bool{}
+	write := func(k string) {
+		if seen[k] {
+			return
+		}
+		seen[k] = true
+		for _, v := range values[k] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(url.QueryEscape(k))
+			buf.WriteByte('=')
+			buf.WriteString(url.QueryEscape(v))
+		}
+	}
+	for _, k := range keys {
+		write(k)
+	}
+	rest := url.Values{}
+	for k, v := range values {
+		if !seen[k] {
+			rest[k] = v
+		}
+	}
+	if encoded := rest.Encode(); len(encoded) > 0 {
+		if buf.Len() > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(encoded)
+	}
+	return buf.String()
+}
+
+func (r *Request) Body(obj interface{}) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.bodyLength = 0
+	switch t := obj.(type) {
+	case string:
+		data, err := ioutil.ReadFile(t)
+		if err != nil {
+			r.err = err
+			return r
+		}
+		r.body = bytes.NewReader(data)
+	case []byte:
+		r.body = bytes.NewReader(t)
+	case io.Reader:
+		r.body = t
+	default:
+		r.err = fmt.Errorf("unknown type used for body: %+v", obj)
+	}
+	return r
+}
+
+// JSONOptions tune how JSONBody encodes the body.
+type JSONOptions struct {
+	// DisableHTMLEscape leaves <, > and & as is instead of escaping them
+	// as \u003c, \u003e and \u0026.
+	DisableHTMLEscape bool
+	// Indent, when set, indents the body with it, like json.MarshalIndent.
+	Indent string
+}
+
+// JSONBody marshals v as JSON into the body and sets the Content-Type header
+// to application/json. With nil opts the marshaler registered for
+// application/json is used.
+func (r *Request) JSONBody(v interface{}, opts *JSONOptions) *Request {
+	if opts == nil {
+		return r.marshalBody("application/json", v, nil)
+	}
+	if r.err != nil {
+		return r
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(!opts.DisableHTMLEscape)
+	enc.SetIndent("", opts.Indent)
+	if err := enc.Encode(v); err != nil {
+		r.err = err
+		return r
+	}
+	r.body = bytes.NewReader(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	r.bodyLength = 0
+	return r.Header("Content-Type", "application/json")
+}
+
+// YAMLBody marshals v as YAML into the body and sets the Content-Type header
+// to application/yaml.
+func (r *Request) YAMLBody(v interface{}) *Request {
+	return r.marshalBody("application/yaml", v, nil)
+}
+
+// XMLBody marshals v as XML into the body and sets the Content-Type header
+// to application/xml. With withHeader the body starts with xml.Header.
+func (r *Request) XMLBody(v interface{}, withHeader bool) *Request {
+	var prefix []byte
+	if withHeader {
+		prefix = []byte(xml.Header)
+	}
+	return r.marshalBody("application/xml", v, prefix)
+}
+
+// marshalBody encodes v with the marshaler registered for mediaType and
+// uses it, after prefix, as the body.
+func (r *Request) marshalBody(mediaType string, v interface{}, prefix []byte) *Request {
+	if r.err != nil {
+		return r
+	}
+	marshal, ok := lookupMarshaler(mediaType)
+	if !ok {
+		r.err = fmt.Errorf("no marshaler registered for %s", mediaType)
+		return r
+	}
+	data, err := marshal(v)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if len(prefix) > 0 {
+		data = append(append([]byte(nil), prefix...), data...)
+	}
+	r.body = bytes.NewReader(data)
+	r.bodyLength = 0
+	return r.Header("Content-Type", mediaType)
+}
+
+// Signer sets a function that is called with the fully built *http.Request
+// right before every attempt is sent, e.g. to compute a signature over the
+// canonical request. The body is buffered so that the signer can read it
+// through req.GetBody without consuming what is sent.
+func (r *Request) Signer(fn func(*http.Request) error) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.signer = fn
+	return r
+}
+
+// UseNumber makes Into decode JSON numbers into an interface{} as json.Number
+// instead of float64, so that large integer IDs keep their precision. It
+// always uses encoding/json, bypassing RegisterUnmarshaler.
+func (r *Request) UseNumber() *Request {
+	if r.err != nil {
+		return r
+	}
+	r.useNumber = true
+	return r
+}
+
+// TeeResponseBody writes a copy of the response body to w, e.g. for audit
+// logging. The copy is the decoded body as read by Raw and Into; errors
+// returned by w are ignored so that they never fail the request.
+func (r *Request) TeeResponseBody(w io.Writer) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.tee = w
+	return r
+}
+
+// BodyBytes returns a copy of the body that will be sent, without consuming
+// it. A body that cannot seek is read into memory and replaced by the
+// buffered copy.
+func (r *Request) BodyBytes() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := r.prepareBody(); err != nil {
+		r.err = err
+		return nil, err
+	}
+	if r.body == nil {
+		return nil, nil
+	}
+	if _, ok := r.body.(io.Seeker); !ok {
+		if err := r.bufferBody(); err != nil {
+			r.err = err
+			return nil, err
+		}
+	}
+
+	seeker := r.body.(io.Seeker)
+	pos, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r.body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := seeker.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GzipBody compresses the body with gzip and sets the Content-Encoding
+// header to gzip. A body that cannot seek, such as a plain io.Reader, is
+// compressed while it is sent instead of in memory; such a body cannot be
+// sent again by retries unless it is buffered first with BodyBytes.
+func (r *Request) GzipBody() *Request {
+	return r.GzipBodyOverThreshold(0)
+}
+
+// GzipBodyOverThreshold is like GzipBody, but only compresses bodies larger
+// than n bytes. Smaller bodies, for which compression costs more than it
+// saves, are sent as is without a Content-Encoding header.
+func (r *Request) GzipBodyOverThreshold(n int) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.gzipBody = true
+	r.gzipThreshold = n
+	return r
+}
+
+// prepareBody builds the body that is sent from the multipart parts and
+// compresses it. It runs before the body is first read and is a no-op
+// afterwards.
+func (r *Request) prepareBody() error {
+	if len(r.multipart) > 0 {
+		r.streamMultipart()
+	}
+	if !r.gzipBody || r.body == nil {
+		return nil
+	}
+	r.gzipBody = false
+
+	if _, ok := r.body.(io.Seeker); !ok {
+		return r.streamGzip()
+	}
+	if err := r.bufferBody(); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r.body)
+	if err != nil {
+		return err
+	}
+	if len(data) <= r.gzipThreshold {
+		r.body = bytes.NewReader(data)
+		return nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	r.body = bytes.NewReader(buf.Bytes())
+	r.bodyLength = 0
+	r.Header("Content-Encoding", "gzip")
+	return nil
+}
+
+// streamGzip compresses a body that cannot seek while it is sent, so that
+// it is never held in memory. Only the first gzipThreshold bytes are read
+// upfront to decide whether to compress at all.
+func (r *Request) streamGzip() error {
+	head, err := ioutil.ReadAll(io.LimitReader(r.body, int64(r.gzipThreshold)+1))
+	if err != nil {
+		return err
+	}
+	if len(head) <= r.gzipThreshold {
+		r.body = bytes.NewReader(head)
+		return nil
+	}
+
+	src := io.MultiReader(bytes.NewReader(head), r.body)
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		if _, err := io.Copy(zw, src); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+		_ = pw.CloseWithError(zw.Close())
+	}()
+	r.body = pr
+	r.bodyLength = 0
+	r.Header("Content-Encoding", "gzip")
+	return nil
+}
+
+// bufferBody reads a streaming body into memory so that it can be read more
+// than once.
+func (r *Request) bufferBody() error {
+	switch r.body.(type) {
+	case nil, *bytes.Reader, *strings.Reader:
+		return nil
+	}
+	data, err := ioutil.ReadAll(r.body)
+	if err != nil {
+		return err
+	}
+	r.body = bytes.NewReader(data)
+	return nil
+}
+
+// cloneHeader copies h so that per-attempt changes do not leak into the
+// headers of the Request. The result is never nil.
+func cloneHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// BodyReader streams body with a known Content-Length, e.g. a file handle
+// with the size from Stat, without buffering it. Retries can only replay the
+// body when it is also an io.Seeker, such as *os.File; otherwise the first
+// response is returned as is.
+func (r *Request) BodyReader(body io.Reader, length int64) *Request {
+	if r.err != nil {
+		return r
+	}
+	if length < 0 {
+		r.err = fmt.Errorf("invalid body length %d", length)
+		return r
+	}
+	r.body = body
+	r.bodyLength = length
+	return r
+}
+
+func (r *Request) URL() *url.URL {
+	p := r.pathPrefix
+
+	finalURL := &url.URL{}
+	if r.baseURL != nil {
+		*finalURL = *r.baseURL
+	}
+	finalURL.Path = p
+	finalURL.RawPath = ""
+	if r.rawPath != "" {
+		finalURL.RawPath = r.escapedPath()
+	}
+
+	if len(r.rawQuery) > 0 {
+		finalURL.RawQuery = r.rawQuery
+		return finalURL
+	}
+
+	query := url.Values{}
+	for key, values := range r.params {
+		for _, value := range values {
+			query.Add(key, value)
+		}
+	}
+
+	// timeout is handled specially here.
+	if r.timeout != 0 && r.timeoutParam {
+		query.Set("timeout", r.timeout.String())
+	}
+	if r.orderedParams {
+		finalURL.RawQuery = encodeOrdered(query, r.paramOrder)
+	} else {
+		finalURL.RawQuery = query.Encode()
+	}
+	return finalURL
+}
+
+// HTTPRequest builds the *http.Request that Do would send, including its
+// URL, headers and body, without sending it.
+func (r *Request) HTTPRequest() (req *http.Request, err error) {
+	defer func() {
+		if err != nil {
+			r.releaseBody()
+		}
+	}()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := r.prepareBody(); err != nil {
+		r.err = err
+		return nil, err
+	}
+	if r.signer != nil {
+		if err := r.bufferBody(); err != nil {
+			return nil, err
+		}
+	}
+	if r.digest != "" {
+		if err := r.setDigest(); err != nil {
+			return nil, err
+		}
+	}
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return r.newHTTPRequest(r.correlate(ctx))
+}
+
+// DryRun returns the request that Do would send as raw HTTP, with the
+// request line, headers and body, without any network I/O.
+func (r *Request) DryRun() (string, error) {
+	body, err := r.BodyBytes()
+	if err != nil {
+		return "", err
+	}
+	req, err := r.HTTPRequest()
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	dump, err := httputil.DumpRequest(req, true)
+	if err != nil {
+		return "", err
+	}
+	return string(dump), nil
+}
+
+// newHTTPRequest builds the *http.Request for a single attempt.
+func (r *Request) newHTTPRequest(ctx context.Context) (*http.Request, error) {
+	verb := r.verb
+	if r.methodOverride && verb != "GET" && verb != "POST" {
+		verb = "POST"
+	}
+	req, err := http.NewRequest(verb, r.URL().String(), r.body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if r.bodyLength > 0 {
+		req.ContentLength = r.bodyLength
+	}
+	if len(r.trailers) > 0 {
+		req.Trailer = cloneHeader(r.trailers)
+		// trailers are only sent with a chunked body.
+		req.ContentLength = -1
+	}
+	req.Header = cloneHeader(r.headers)
+	req.Close = r.closeConn
+	r.setCorrelationHeader(ctx, req.Header)
+	if deadline, ok := ctx.Deadline(); ok && r.deadlineHeader != "" {
+		req.Header.Set(r.deadlineHeader, strconv.FormatInt(int64(time.Until(deadline)/time.Millisecond), 10))
+	}
+	if verb != r.verb {
+		req.Header.Set("X-HTTP-Method-Override", r.verb)
+	}
+	if r.credentials != nil {
+		creds, err := r.credentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		creds.apply(req)
+	}
+	if r.cache != nil && verb == "GET" && req.Header.Get("If-None-Match") == "" {
+		if etag, ok := r.cache.etag(req.URL.String()); ok && etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+	}
+	if r.signer != nil {
+		if err := r.signer(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func (r *Request) Stream() (rc io.ReadCloser, err error) {
+	defer func() {
+		if err != nil {
+			r.releaseBody()
+		}
+	}()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := r.prepareBody(); err != nil {
+		r.err = err
+		return nil, err
+	}
+	if r.signer != nil {
+		if err := r.bufferBody(); err != nil {
+			return nil, err
+		}
+	}
+	if r.digest != "" {
+		if err := r.setDigest(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := r.requestContext()
+	req, err := r.newHTTPRequest(r.withTrace(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	httpUrl := req.URL.String()
+	client := r.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := r.send(client)(req)
+	if err != nil {
+		cancel()
+		return nil, wrapTimeout(err)
+	}
+
+	switch {
+	case (resp.StatusCode >= 200) && (resp.StatusCode < 300):
+		return &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}, nil
+
 	default:
-		r.err = fmt.Errorf("unknown type used for body: %+v", obj)
+		// ensure we close the body before returning the error
+		defer func() {
+			_ = resp.Body.Close()
+			cancel()
+		}()
+
+		result := r.transformResponse(resp, req)
+		if r.cache != nil && resp.StatusCode == http.StatusNotModified {
+			if cached := r.cache.update(httpUrl, result); cached.fromCache {
+				return ioutil.NopCloser(bytes.NewReader(cached.body)), nil
+			}
+		}
+		err := result.Error()
+		if err == nil {
+			err = fmt.Errorf("%d while accessing %v: %s", result.statusCode, httpUrl, string(result.body))
+		}
+		return nil, err
+	}
+}
+
+// cancelOnClose releases the context of a streamed response once its body
+// is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// CloseConnection sends "Connection: close" and closes the connection once
+// the response is read, for servers that mishandle keep-alive. Unlike
+// disabling keep-alive on the transport it only affects this request.
+func (r *Request) CloseConnection() *Request {
+	if r.err != nil {
+		return r
+	}
+	r.closeConn = true
+	return r
+}
+
+// MethodOverride sends verbs other than GET and POST as POST requests with
+// the real verb in the X-HTTP-Method-Override header, for proxies and servers
+// that only accept GET and POST.
+func (r *Request) MethodOverride() *Request {
+	if r.err != nil {
+		return r
+	}
+	r.methodOverride = true
+	return r
+}
+
+// SingleFlight makes identical GET requests that are in flight at the same
+// time, keyed by method, URL and headers, share a single round trip and its
+// Result, so that callers with other credentials never see each other's
+// responses. Requests authenticated per attempt, with CredentialsFromContext
+// or a Signer, are never shared. The shared Result must be treated as
+// read-only, and its body is kept in memory even with SpillToDiskOver, since
+// any caller may Close it.
+func (r *Request) SingleFlight(group *singleflight.Group) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.flight = group
+	return r
+}
+
+func (r *Request) Do() Result {
+	if r.coalescable() && r.err == nil {
+		v, _, shared := r.flight.Do(r.flightKey(), func() (interface{}, error) {
+			return r.do(), nil
+		})
+		result := v.(Result)
+		result.coalesced = shared
+		return result
+	}
+	return r.do()
+}
+
+// coalescable reports whether SingleFlight may share the request.
+func (r *Request) coalescable() bool {
+	return r.flight != nil && r.verb == "GET" && r.credentials == nil && r.signer == nil
+}
+
+// flightKey identifies the requests that SingleFlight may share. The
+// headers are hashed so that credentials are not kept in the key.
+func (r *Request) flightKey() string {
+	names := make([]string, 0, len(r.headers))
+	for name := range r.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		for _, value := range r.headers[name] {
+			fmt.Fprintf(h, "%s: %s\n", name, value)
+		}
+	}
+	return r.verb + " " + r.URL().String() + " " + hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *Request) do() (result Result) {
+	if observe := r.observer; observe != nil {
+		start := time.Now()
+		defer func() {
+			observe(r.verb, r.URL().Host, result.statusCode, time.Since(start))
+		}()
+	}
+	err := r.request(func(req *http.Request, resp *http.Response, kept error) {
+		result = r.transformResponse(resp, req)
+		if kept != nil {
+			if result.err == nil {
+				result.err = kept
+			} else {
+				result.err = fmt.Errorf("%w, %v", result.err, kept)
+			}
+		}
+		result.request = r
+		result.url = req.URL
+		result.tlsState = resp.TLS
+		if hops, ok := req.Context().Value(redirectChainKey{}).(*[]RedirectHop); ok {
+			result.redirects = *hops
+		}
+		if r.baseURL != nil {
+			result.stats.Endpoint = r.baseURL.String()
+		}
+		result.stats.Timings = collectedTimings(req.Context())
+		if r.cache != nil && r.verb == "GET" {
+			result = r.cache.update(req.URL.String(), result)
+		}
+	})
+	if err != nil {
+		result = Result{err: wrapTimeout(err)}
+	}
+	return result
+}
+
+// ResponseObserver is called once for every request that completes, after
+// its retries, with the final status code, or 0 if no response was
+// received.
+type ResponseObserver func(method, host string, status int, dur time.Duration)
+
+// ResponseObserver sets the function observing the request once it
+// completes, e.g. to count errors by status code or record latencies.
+// Requests derived from it, such as the pages of DoAll, keep the observer.
+func (r *Request) ResponseObserver(fn ResponseObserver) *Request {
+	if r.err != nil {
+		return r
 	}
+	r.observer = fn
 	return r
 }
 
-func (r *Request) URL() *url.URL {
-	p := r.pathPrefix
+// OnUnauthorized sets a function called when the server responds with 401
+// Unauthorized. The request is then retried once with the returned token as
+// "Authorization: Bearer <token>"; a second 401 is returned to the caller.
+func (r *Request) OnUnauthorized(refresh func(ctx context.Context) (newToken string, err error)) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.onUnauthorized = refresh
+	return r
+}
 
-	finalURL := &url.URL{}
-	if r.baseURL != nil {
-		*finalURL = *r.baseURL
+// Use adds middlewares that wrap the sending of every attempt, retries
+// included. The first middleware added runs first.
+func (r *Request) Use(mw ...Middleware) *Request {
+	if r.err != nil {
+		return r
 	}
-	finalURL.Path = p
+	r.middlewares = append(r.middlewares, mw...)
+	return r
+}
 
-	query := url.Values{}
-	for key, values := range r.params {
-		for _, value := range values {
-			query.Add(key, value)
-		}
+// send returns the function that sends an attempt through the middlewares.
+func (r *Request) send(client *http.Client) RoundTripFunc {
+	fn := RoundTripFunc(client.Do)
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		fn = r.middlewares[i](fn)
 	}
+	return fn
+}
 
-	// timeout is handled specially here.
-	if r.timeout != 0 {
-		query.Set("timeout", r.timeout.String())
+// defaultMaxBodySlurpSize is how much of a response body is drained by
+// default before it is closed.
+const defaultMaxBodySlurpSize = 2 << 10
+
+// isSuccessStatus reports whether a response with code is decoded rather
+// than turned into an error.
+func (r *Request) isSuccessStatus(code int) bool {
+	if code == http.StatusSwitchingProtocols {
+		return true
 	}
-	finalURL.RawQuery = query.Encode()
-	return finalURL
+	return code >= http.StatusOK && code <= http.StatusPartialContent && !r.errorStatuses[code]
 }
 
-func (r *Request) Stream() (io.ReadCloser, error) {
+// CapErrorBody reads at most the first 2KB of the body of an unsuccessful
+// response, which is all its error message keeps, instead of loading a
+// large error page into memory. Raw and IntoError then see the truncated
+// body.
+func (r *Request) CapErrorBody() *Request {
 	if r.err != nil {
-		return nil, r.err
+		return r
 	}
+	r.capErrorBody = true
+	return r
+}
 
-	httpUrl := r.URL().String()
-	req, err := http.NewRequest(r.verb, httpUrl, nil)
-	if err != nil {
-		return nil, err
-	}
-	if r.ctx != nil {
-		req = req.WithContext(r.ctx)
+type getBodyPolicy int
+
+const (
+	// getBodyUnset sends GET bodies with a warning in the log, the standard
+	// one when no logger is set.
+	getBodyUnset getBodyPolicy = iota
+	getBodyAllowed
+	getBodyRejected
+)
+
+// AllowGetBody decides whether a GET request may have a body, which many
+// servers and proxies mishandle. When allowed it is sent silently, otherwise
+// the request fails. By default it is sent and a warning is logged, to the
+// standard logger unless WithLogger was set.
+func (r *Request) AllowGetBody(allow bool) *Request {
+	if r.err != nil {
+		return r
 	}
-	req.Header = r.headers
-	client := r.client
-	if client == nil {
-		client = http.DefaultClient
+	r.getBody = getBodyRejected
+	if allow {
+		r.getBody = getBodyAllowed
 	}
+	return r
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// ErrorOnStatus makes the given status codes fail the result like any
+// unsuccessful status, e.g. a 202 Accepted where a flow needs the final
+// answer.
+func (r *Request) ErrorOnStatus(codes ...int) *Request {
+	if r.err != nil {
+		return r
 	}
-
-	switch {
-	case (resp.StatusCode >= 200) && (resp.StatusCode < 300):
-		return resp.Body, nil
-
-	default:
-		// ensure we close the body before returning the error
-		defer func() {
-			_ = resp.Body.Close()
-		}()
-
-		result := r.transformResponse(resp, req)
-		err := result.Error()
-		if err == nil {
-			err = fmt.Errorf("%d while accessing %v: %s", result.statusCode, httpUrl, string(result.body))
-		}
-		return nil, err
+	if r.errorStatuses == nil {
+		r.errorStatuses = map[int]bool{}
+	}
+	for _, code := range codes {
+		r.errorStatuses[code] = true
 	}
+	return r
 }
 
-func (r *Request) Do() Result {
-	var result Result
-	err := r.request(func(req *http.Request, resp *http.Response) {
-		result = r.transformResponse(resp, req)
-	})
-	if err != nil {
-		return Result{err: err}
+// MaxBodySlurpSize sets how many bytes of a response body that is discarded
+// before a retry are drained so that the TCP connection can be reused.
+// Bodies larger than n close the connection instead. The default is 2KB.
+func (r *Request) MaxBodySlurpSize(n int64) *Request {
+	if r.err != nil {
+		return r
 	}
-	return result
+	r.maxSlurpSize = n
+	return r
 }
 
-func (r *Request) request(fn func(*http.Request, *http.Response)) error {
+// request sends the request until fn can be handed a final response. The
+// error passed to fn tells why resp was kept although it should have been
+// retried.
+func (r *Request) request(fn func(req *http.Request, resp *http.Response, kept error)) error {
+	defer r.releaseBody()
 	if r.err != nil {
 		return r.err
 	}
 
+	r.redirectPolicy()
 	client := r.client
-	if client == nil {
-		client = http.DefaultClient
+
+	endpoint := 0
+	if n := len(r.endpoints); n > 0 {
+		if r.endpointPolicy == RoundRobin {
+			endpoint = int((atomic.AddUint32(&roundRobinCounter, 1) - 1) % uint32(n))
+		}
+		r.rebase(r.endpoints[endpoint])
+	}
+	failovers := 0
+
+	if err := r.prepareBody(); err != nil {
+		r.err = err
+		return err
+	}
+	if r.verb == "GET" && r.body != nil {
+		switch r.getBody {
+		case getBodyRejected:
+			return fmt.Errorf("a GET request must not have a body, allow it with AllowGetBody(true)")
+		case getBodyUnset:
+			warn := r.logf
+			if _, ok := r.logger.(nopLogger); ok {
+				// without a logger the warning would be lost.
+				warn = log.Printf
+			}
+			warn("request: GET %s has a body, which some servers and proxies drop or reject", r.URL())
+		}
+	}
+	if r.signer != nil {
+		if err := r.bufferBody(); err != nil {
+			return err
+		}
+	}
+	if r.digest != "" {
+		if err := r.setDigest(); err != nil {
+			return err
+		}
 	}
 
+	ctx, cancel := r.requestContext()
+	defer cancel()
+	send := r.send(client)
+
 	maxRetries := 10
 	retries := 0
+	refreshed := false
+	// abortErr ends the request with an error instead of a result.
+	var abortErr error
+	var delay time.Duration
 	for {
-		httpUrl := r.URL().String()
-		req, err := http.NewRequest(r.verb, httpUrl, r.body)
+		var hops []RedirectHop
+		req, err := r.newHTTPRequest(r.withTrace(context.WithValue(ctx, redirectChainKey{}, &hops)))
 		if err != nil {
 			return err
 		}
-		if r.ctx != nil {
-			req = req.WithContext(r.ctx)
-		}
-		req.Header = r.headers
+		httpUrl := req.URL.String()
 
-		resp, err := client.Do(req)
+		resp, err := send(req)
+		if err != nil && failovers+1 < len(r.endpoints) && r.canFailOver(err) {
+			if rerr := r.rewindBody(); rerr != nil {
+				return fmt.Errorf("%v, not failing over: %v", err, rerr)
+			}
+			failovers++
+			endpoint = (endpoint + 1) % len(r.endpoints)
+			r.logf("request: %s %s failed: %v, failing over to %s", r.verb, httpUrl, err, r.endpoints[endpoint])
+			r.rebase(r.endpoints[endpoint])
+			continue
+		}
+		var resetErr error
 		if err != nil {
-			if !IsConnectionReset(err) || r.verb != "GET" {
+			if !IsConnectionReset(err) || !resetRetryVerbs[r.verb] {
 				return err
 			}
+			r.logf("request: %s %s: connection reset by peer", r.verb, httpUrl)
+			resetErr = err
 
 			resp = &http.Response{
 				StatusCode: http.StatusInternalServerError,
@@ -395,47 +2395,234 @@ func (r *Request) request(fn func(*http.Request, *http.Response)) error {
 			// before we reconnect, so that we reuse the same TCP
 			// connection.
 			defer func() {
-				const maxBodySlurpSize = 2 << 10
+				maxBodySlurpSize := r.maxSlurpSize
+				if maxBodySlurpSize <= 0 {
+					maxBodySlurpSize = defaultMaxBodySlurpSize
+				}
 				if resp.ContentLength <= maxBodySlurpSize {
 					_, _ = io.Copy(ioutil.Discard, &io.LimitedReader{R: resp.Body, N: maxBodySlurpSize})
 				}
 				_ = resp.Body.Close()
 			}()
 
+			if resp.StatusCode == http.StatusUnauthorized && r.onUnauthorized != nil && !refreshed {
+				refreshed = true
+				if err := r.rewindBody(); err != nil {
+					r.logf("request: %s %s: not refreshing credentials: %v", r.verb, httpUrl, err)
+					fn(req, resp, fmt.Errorf("not refreshing credentials: %v", err))
+					return true
+				}
+				token, err := r.onUnauthorized(ctx)
+				if err != nil {
+					abortErr = err
+					return true
+				}
+				r.logf("request: %s %s got 401, retrying with refreshed credentials", r.verb, httpUrl)
+				r.Header("Authorization", "Bearer "+token)
+				return false
+			}
+
 			retries++
-			if _, wait := checkWait(resp); wait && retries < maxRetries {
-				if seeker, ok := r.body.(io.Seeker); ok && r.body != nil {
-					_, err := seeker.Seek(0, 0)
-					if err != nil {
-						fn(req, resp)
+			seconds, wait := checkWait(resp)
+			if r.retryDecider != nil {
+				wait = r.retryDecider(resp, peekBody(resp))
+			}
+			if wait && retries < maxRetries {
+				if err := r.rewindBody(); err != nil {
+					r.logf("request: %s %s: not retrying, unable to rewind body: %v", r.verb, httpUrl, err)
+					if resetErr != nil {
+						// there is no response to hand back.
+						abortErr = resetErr
 						return true
 					}
+					fn(req, resp, fmt.Errorf("not retrying, unable to rewind body: %v", err))
+					return true
 				}
+				delay = r.retryAfter(seconds)
+				r.logf("request: %s %s got %d, retrying after %v (attempt %d of %d)", r.verb, httpUrl, resp.StatusCode, delay, retries+1, maxRetries)
 				return false
+			} else if wait {
+				r.logf("request: %s %s got %d, giving up after %d attempts", r.verb, httpUrl, resp.StatusCode, retries)
+			}
+			body := &truncationRecorder{ReadCloser: resp.Body}
+			resp.Body = body
+			fn(req, resp, nil)
+			if body.truncated && isIdempotent(r.verb) && retries < maxRetries {
+				if err := r.rewindBody(); err == nil {
+					r.logf("request: %s %s: response body was truncated, retrying (attempt %d of %d)", r.verb, httpUrl, retries+1, maxRetries)
+					return false
+				}
 			}
-			fn(req, resp)
 			return true
 		}()
+		if abortErr != nil {
+			return abortErr
+		}
 		if done {
 			return nil
 		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			delay = 0
+		}
+	}
+}
+
+// defaultMaxRetryAfter caps the delay of a Retry-After header unless
+// MaxRetryAfter is set.
+const defaultMaxRetryAfter = 10 * time.Second
+
+// MaxRetryAfter caps how long a retry waits for the delay in a Retry-After
+// header, 10 seconds by default; a negative d honors the header in full.
+// Capped delays are spread randomly over the second half of d so that
+// clients throttled together do not all retry at once.
+func (r *Request) MaxRetryAfter(d time.Duration) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.maxRetryAfter = d
+	return r
+}
+
+// retryAfter returns how long to wait before retrying when the server asked
+// for a delay of seconds.
+func (r *Request) retryAfter(seconds int) time.Duration {
+	wait := time.Duration(seconds) * time.Second
+	max := r.maxRetryAfter
+	if max == 0 {
+		max = defaultMaxRetryAfter
+	}
+	if max > 0 && wait > max {
+		wait = max/2 + time.Duration(mathrand.Int63n(int64(max/2)+1))
+	}
+	return wait
+}
+
+// retryPeekSize is how much of a response body a RetryDecider sees.
+const retryPeekSize = 4 << 10
+
+// RetryDecider has the final say on whether a response is retried, instead
+// of retrying 429 and 5xx responses that carry a Retry-After header. It is
+// given up to the first 4KB of the body, which remain part of the result,
+// e.g. to stop retrying a 503 that reports a permanent outage. Retries still
+// wait for Retry-After when present.
+func (r *Request) RetryDecider(fn func(resp *http.Response, body []byte) bool) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.retryDecider = fn
+	return r
+}
+
+// peekBody returns the start of the body of resp without consuming it.
+func peekBody(resp *http.Response) []byte {
+	peek, _ := ioutil.ReadAll(io.LimitReader(resp.Body, retryPeekSize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), resp.Body), resp.Body}
+	return peek
+}
+
+// truncationRecorder notes whether a response body ended before its
+// Content-Length, as happens when a kept-alive connection is closed midway.
+type truncationRecorder struct {
+	io.ReadCloser
+	truncated bool
+}
+
+func (t *truncationRecorder) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		t.truncated = true
+	}
+	return n, err
+}
+
+// idempotentVerbs may be sent again without changing the outcome. PURGE
+// and BAN invalidate caches such as Varnish and Fastly.
+var idempotentVerbs = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+	"PURGE":   true,
+	"BAN":     true,
+}
+
+// resetRetryVerbs are sent again when the connection is reset before a
+// response arrives. They normally carry no body, unlike PUT and DELETE.
+var resetRetryVerbs = map[string]bool{
+	"GET":   true,
+	"HEAD":  true,
+	"PURGE": true,
+	"BAN":   true,
+}
+
+func isIdempotent(verb string) bool {
+	return idempotentVerbs[verb]
+}
+
+// rewindBody seeks the body back to its start so that it can be sent again.
+func (r *Request) rewindBody() error {
+	if r.body == nil {
+		return nil
+	}
+	seeker, ok := r.body.(io.Seeker)
+	if _, streamed := r.body.(*io.PipeReader); streamed {
+		return errors.New("the body is encoded while it is sent and cannot be sent again, buffer it with BodyBytes first to allow retries")
+	}
+	if !ok {
+		return fmt.Errorf("body of type %T cannot be sent again", r.body)
 	}
+	_, err := seeker.Seek(0, io.SeekStart)
+	return err
 }
 
 func (r *Request) transformResponse(resp *http.Response, req *http.Request) Result {
 	var body []byte
+	var spill *spillFile
+	if resp.Body != nil && r.mustDecompress(req, resp) {
+		if err := decodeContentEncoding(resp); err != nil {
+			return Result{
+				err: err,
+			}
+		}
+	}
 	if resp.Body != nil {
-		data, err := ioutil.ReadAll(resp.Body)
+		var bodyReader io.Reader = resp.Body
+		if r.capErrorBody && !r.isSuccessStatus(resp.StatusCode) {
+			bodyReader = io.LimitReader(resp.Body, maxUnstructuredResponseTextBytes)
+		}
+		data, spilled, err := r.readBody(bodyReader, r.isSuccessStatus(resp.StatusCode))
 
 		switch err.(type) {
 		case nil:
-			body = data
+			body, spill = data, spilled
+			if r.tee != nil && spill != nil {
+				_, _ = io.Copy(r.tee, spill.reader())
+			} else if r.tee != nil {
+				_, _ = r.tee.Write(body)
+			}
 		case http2.StreamError:
 			streamErr := fmt.Errorf("Stream error %#v when reading response body, may be caused by closed connection. Please retry.", err)
 			return Result{
 				err: streamErr,
 			}
 		default:
+			if isTimeout(err) {
+				return Result{
+					err: wrapTimeout(err),
+				}
+			}
 			unexpectedErr := fmt.Errorf("Unexpected error %#v when reading response body. Please retry.", err)
 			return Result{
 				err: unexpectedErr,
@@ -445,12 +2632,15 @@ func (r *Request) transformResponse(resp *http.Response, req *http.Request) Resu
 
 	// verify the content type is accurate
 	contentType := resp.Header.Get("Content-Type")
-	decoder := NewDecode()
+	var decoder Decoder = &decode{useNumber: r.useNumber, maxDepth: r.maxDepth}
+	if r.decoder != nil {
+		decoder = r.decoder
+	}
 
 	switch {
 	case resp.StatusCode == http.StatusSwitchingProtocols:
 		// no-op, we've been upgraded
-	case resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusPartialContent:
+	case !r.isSuccessStatus(resp.StatusCode):
 		return Result{
 			body:        body,
 			contentType: contentType,
@@ -462,7 +2652,7 @@ func (r *Request) transformResponse(resp *http.Response, req *http.Request) Resu
 		}
 	}
 
-	return Result{
+	result := Result{
 		body:        body,
 		contentType: contentType,
 		statusCode:  resp.StatusCode,
@@ -470,6 +2660,56 @@ func (r *Request) transformResponse(resp *http.Response, req *http.Request) Resu
 		headers:     resp.Header,
 		cookies:     resp.Cookies(),
 	}
+	if spill != nil {
+		result.spill = spill
+		result.closer = &onceCloser{closer: spill}
+	}
+	return result
+}
+
+// mustDecompress reports whether the body of resp is still encoded. The
+// transport decompresses gzip and sets resp.Uncompressed only when it added
+// Accept-Encoding itself; when the header was sent by us, through
+// AcceptEncoding, Header or FromHTTPRequest, the body is left as the server
+// sent it.
+func (r *Request) mustDecompress(req *http.Request, resp *http.Response) bool {
+	if resp.Uncompressed {
+		return false
+	}
+	return r.decompress || req.Header.Get("Accept-Encoding") != ""
+}
+
+// decodeContentEncoding replaces resp.Body with a reader that undoes the
+// Content-Encoding of the response, the same way the transport does when it
+// negotiates gzip on its own.
+func decodeContentEncoding(resp *http.Response) error {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("Unable to read gzip response body: %v", err)
+		}
+		reader = gr
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("Unable to read deflate response body: %v", err)
+		}
+		reader = zr
+	default:
+		return nil
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
 }
 
 const maxUnstructuredResponseTextBytes = 2048
@@ -507,34 +2747,138 @@ func (r *Request) newUnstructuredResponseError(body []byte, isTextResponse bool,
 	return NewGenericServerResponse(statusCode, message)
 }
 
+// UnmarshalFunc decodes data into v, like json.Unmarshal.
+type UnmarshalFunc func(data []byte, v interface{}) error
+
+// MarshalFunc encodes v, like json.Marshal.
+type MarshalFunc func(v interface{}) ([]byte, error)
+
+var (
+	codecMu sync.RWMutex
+
+	unmarshalers = map[string]UnmarshalFunc{
+		"application/json": json.Unmarshal,
+		"application/yaml": yaml.Unmarshal,
+		"application/xml":  xml.Unmarshal,
+		"text/xml":         xml.Unmarshal,
+	}
+	marshalers = map[string]MarshalFunc{
+		"application/json": json.Marshal,
+		"application/yaml": yaml.Marshal,
+		"application/xml":  xml.Marshal,
+		"text/xml":         xml.Marshal,
+	}
+)
+
+// RegisterUnmarshaler sets the function used to decode responses of the
+// given media type, e.g. to swap encoding/json for json-iterator. A nil fn
+// removes the media type.
+func RegisterUnmarshaler(mediaType string, fn UnmarshalFunc) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	if fn == nil {
+		delete(unmarshalers, mediaType)
+		return
+	}
+	unmarshalers[mediaType] = fn
+}
+
+// RegisterMarshaler sets the function used to encode request bodies of the
+// given media type. A nil fn removes the media type.
+func RegisterMarshaler(mediaType string, fn MarshalFunc) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	if fn == nil {
+		delete(marshalers, mediaType)
+		return
+	}
+	marshalers[mediaType] = fn
+}
+
+func lookupUnmarshaler(mediaType string) (UnmarshalFunc, bool) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	fn, ok := unmarshalers[mediaType]
+	return fn, ok
+}
+
+func lookupMarshaler(mediaType string) (MarshalFunc, bool) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	fn, ok := marshalers[mediaType]
+	return fn, ok
+}
+
+// decodableMediaTypes returns the media types with a registered unmarshaler.
+func decodableMediaTypes() []string {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	mediaTypes := make([]string, 0, len(unmarshalers))
+	for mediaType := range unmarshalers {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	return mediaTypes
+}
+
 type decode struct {
+	// useNumber decodes JSON numbers into json.Number instead of float64.
+	useNumber bool
+	// maxDepth, when set, rejects data nested deeper.
+	maxDepth int
 }
 
 func NewDecode() Decoder {
 	return &decode{}
 }
 
+// Decode decodes data with the unmarshaler registered for mediaType, or for
+// its structured syntax suffix such as +json. Media types without an
+// unmarshaler are rejected rather than silently left undecoded.
 func (c *decode) Decode(data []byte, mediaType string, into interface{}) (interface{}, error) {
-	switch mediaType {
-	case "application/json":
-		if err := json.Unmarshal(data, &into); err != nil {
-			return nil, err
+	if i := strings.LastIndex(mediaType, "+"); i >= 0 {
+		if _, ok := lookupUnmarshaler(mediaType); !ok {
+			mediaType = "application/" + mediaType[i+1:]
 		}
-		return into, nil
-	case "application/yaml":
-		if err := yaml.Unmarshal(data, &into); err != nil {
+	}
+	if c.maxDepth > 0 {
+		if err := checkDepth(data, mediaType, c.maxDepth); err != nil {
 			return nil, err
 		}
-		return into, nil
-	case "application/xml", "text/xml":
-		if err := xml.Unmarshal(data, &into); err != nil {
+	}
+
+	if c.useNumber && mediaType == "application/json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&into); err != nil {
 			return nil, err
 		}
 		return into, nil
 	}
+
+	unmarshal, ok := lookupUnmarshaler(mediaType)
+	if !ok {
+		return nil, fmt.Errorf("unable to decode a %s response, expected one of %s", mediaType, strings.Join(decodableMediaTypes(), ", "))
+	}
+	if err := unmarshal(data, decodeTarget(into)); err != nil {
+		return nil, err
+	}
 	return into, nil
 }
 
+// decodeTarget unwraps the pointers to interface{} that Into wraps the
+// caller's value in, so that unmarshalers which do not follow them, such as
+// yaml and xml, decode into the caller's own pointer.
+func decodeTarget(into interface{}) interface{} {
+	for {
+		p, ok := into.(*interface{})
+		if !ok || *p == nil {
+			return into
+		}
+		into = *p
+	}
+}
+
 func IsConnectionReset(err error) bool {
 	if urlErr, ok := err.(*url.Error); ok {
 		err = urlErr.Err
@@ -551,6 +2895,27 @@ func IsConnectionReset(err error) bool {
 	return false
 }
 
+// canFailOver reports whether the request may be sent to the next endpoint
+// after err. A request that never reached the server always may, any other
+// connection failure only when the verb is idempotent, since the server may
+// have acted on it already.
+func (r *Request) canFailOver(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	if !isIdempotent(r.verb) {
+		return false
+	}
+	_, ok := err.(*net.OpError)
+	return ok || IsConnectionReset(err)
+}
+
 func checkWait(resp *http.Response) (int, bool) {
 	switch r := resp.StatusCode; {
 	// any 500 error code and 429 can trigger a wait
@@ -563,12 +2928,97 @@ func checkWait(resp *http.Response) (int, bool) {
 }
 
 func retryAfterSeconds(resp *http.Response) (int, bool) {
-	if h := resp.Header.Get("Retry-After"); len(h) > 0 {
-		if i, err := strconv.Atoi(h); err == nil {
-			return i, true
-		}
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if !ok {
+		return 0, false
+	}
+	return int((d + time.Second - 1) / time.Second), true
+}
+
+// parseRetryAfter parses a Retry-After header, which holds either a number
+// of seconds or an HTTP date. Dates in the past yield zero.
+func parseRetryAfter(h string) (time.Duration, bool) {
+	if len(h) == 0 {
+		return 0, false
+	}
+	if i, err := strconv.Atoi(h); err == nil {
+		return time.Duration(i) * time.Second, true
+	}
+	t, err := http.ParseTime(h)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Until(t); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// TimeoutError is returned when a request does not complete before its
+// timeout or context deadline.
+type TimeoutError struct {
+	Err error
+}
+
+var _ net.Error = &TimeoutError{}
+
+// Error implements the Error interface.
+func (e *TimeoutError) Error() string {
+	return "request timed out: " + e.Err.Error()
+}
+
+// Timeout implements the net.Error interface and is always true.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary implements the net.Error interface.
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// Unwrap returns the underlying error.
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// IsTimeout reports whether err is a *TimeoutError or another timeout.
+func IsTimeout(err error) bool {
+	if _, ok := err.(*TimeoutError); ok {
+		return true
+	}
+	return isTimeout(err)
+}
+
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if urlErr, ok := err.(*url.Error); ok && urlErr.Err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// wrapTimeout turns timeouts into a *TimeoutError and returns other errors
+// unchanged.
+func wrapTimeout(err error) error {
+	if err == nil {
+		return nil
 	}
-	return 0, false
+	if _, ok := err.(*TimeoutError); ok || !isTimeout(err) {
+		return err
+	}
+	return &TimeoutError{Err: err}
+}
+
+// IsPreconditionFailed reports whether err is a *StatusError for a 412
+// Precondition Failed response, e.g. to an update sent with IfMatch after
+// the resource changed.
+func IsPreconditionFailed(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusPreconditionFailed
 }
 
 func NewGenericServerResponse(code int, serverMessage string) *StatusError {
@@ -598,17 +3048,22 @@ func NewGenericServerResponse(code int, serverMessage string) *StatusError {
 		message = "the server was unable to return a response in the time allotted, but may still be processing the request"
 	case http.StatusTooManyRequests:
 		message = "the server has received too many requests and has asked us to try again later"
+	case http.StatusPreconditionFailed:
+		message = "the server rejected our request because a precondition failed, e.g. the resource was modified"
 	default:
 		if code >= 500 {
 			message = fmt.Sprintf("an error on the server (%d) has prevented the request from succeeding", code)
 		}
 	}
 	return &StatusError{
+		Code:    code,
 		Message: message,
 	}
 }
 
 type StatusError struct {
+	// Code is the HTTP status code of the response.
+	Code    int
 	Message string
 }
 
@@ -8,12 +8,34 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 func TestRequest_Do(t *testing.T) {
@@ -76,3 +98,2206 @@ func TestRequest_HttpClient(t *testing.T) {
 
 	t.Log("b", string(b))
 }
+
+func TestRequest_AcceptEncoding(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			t.Errorf("Accept-Encoding = %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		_, _ = gw.Write([]byte(`{"hello": "world"}`))
+		_ = gw.Close()
+	}))
+	defer srv.Close()
+
+	var res map[string]string
+	if err := NewRequest(srv.URL, "GET").AcceptEncoding("gzip").Do().Into(&res); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if res["hello"] != "world" {
+		t.Errorf("res = %v", res)
+	}
+}
+
+func TestRequest_DecompressNegotiated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var zw io.WriteCloser
+		switch enc := r.Header.Get("Accept-Encoding"); enc {
+		case "gzip":
+			zw = gzip.NewWriter(w)
+		case "deflate":
+			zw = zlib.NewWriter(w)
+		default:
+			t.Errorf("Accept-Encoding = %q", enc)
+			return
+		}
+		w.Header().Set("Content-Encoding", r.Header.Get("Accept-Encoding"))
+		_, _ = zw.Write([]byte(`{"hello": "world"}`))
+		_ = zw.Close()
+	}))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		name string
+		req  *Request
+	}{
+		// the transport asks for gzip and decompresses it itself.
+		{"auto", NewRequest(srv.URL, "GET")},
+		{"manual gzip", NewRequest(srv.URL, "GET").Header("Accept-Encoding", "gzip")},
+		{"manual deflate", NewRequest(srv.URL, "GET").Header("Accept-Encoding", "deflate")},
+	} {
+		var res map[string]string
+		result := c.req.Do()
+		if err := result.Into(&res); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if res["hello"] != "world" || result.Header("Content-Encoding") != "" {
+			t.Errorf("%s: res = %v, Content-Encoding = %q", c.name, res, result.Header("Content-Encoding"))
+		}
+	}
+}
+
+func TestRequest_BaseURL(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request hit the primary server")
+	}))
+	defer primary.Close()
+
+	var gotPath, gotQuery, gotHeader string
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery, gotHeader = r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Test")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer secondary.Close()
+
+	req := NewRequest(primary.URL+"/api", "GET").
+		Prefix("v1", "users").
+		Param("a", "b").
+		Header("X-Test", "yes")
+
+	body, err := req.BaseURL(secondary.URL + "/api").Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "ok" {
+		t.Errorf("body = %q", body)
+	}
+	if gotPath != "/api/v1/users" || gotQuery != "a=b" || gotHeader != "yes" {
+		t.Errorf("path = %q, query = %q, header = %q", gotPath, gotQuery, gotHeader)
+	}
+	if req.URL().Host != strings.TrimPrefix(secondary.URL, "http://") {
+		t.Errorf("host = %q", req.URL().Host)
+	}
+}
+
+func TestRequest_Endpoints(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + ln.Addr().String()
+	_ = ln.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	res := NewRequest(down, "POST").
+		Endpoints(down, srv.URL).
+		Prefix("hello").
+		Body([]byte("world")).
+		Do()
+	body, err := res.Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "/hello" {
+		t.Errorf("body = %q", body)
+	}
+	if res.Stats().Endpoint != srv.URL {
+		t.Errorf("endpoint = %q, want %q", res.Stats().Endpoint, srv.URL)
+	}
+}
+
+func TestRequest_EndpointsUnrewindableBody(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + ln.Addr().String()
+	_ = ln.Close()
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+
+	err = NewRequest(down, "POST").
+		Endpoints(down, srv.URL).
+		BodyReader(onlyReader{strings.NewReader("world")}, 5).
+		Do().Error()
+	if err == nil || !strings.Contains(err.Error(), "not failing over") || calls != 0 {
+		t.Errorf("err = %v, %d calls", err, calls)
+	}
+}
+
+func TestRequest_EndpointsNoFailoverAfterSend(t *testing.T) {
+	var dropped, calls int32
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&dropped, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer second.Close()
+
+	err := NewRequest(first.URL, "POST").
+		Endpoints(first.URL, second.URL).
+		Body([]byte("order")).
+		Do().Error()
+	if err == nil || atomic.LoadInt32(&dropped) != 1 || atomic.LoadInt32(&calls) != 0 {
+		t.Errorf("err = %v, POST reached the first endpoint %d times and the second %d times",
+			err, atomic.LoadInt32(&dropped), atomic.LoadInt32(&calls))
+	}
+}
+
+func TestRequest_WithLogger(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	body, err := NewRequest(srv.URL, "GET").
+		WithLogger(log.New(&buf, "", 0)).
+		Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "ok" {
+		t.Errorf("body = %q", body)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines: %q", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "got 503, retrying after 0s") {
+			t.Errorf("unexpected log line %q", line)
+		}
+	}
+}
+
+func TestRequest_RawQuery(t *testing.T) {
+	const raw = "b=2&a=1&sig=a+b/c|d"
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RawQuery
+	}))
+	defer srv.Close()
+
+	if _, err := NewRequest(srv.URL, "GET").RawQuery(raw).Do().Raw(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if got != raw {
+		t.Errorf("raw query = %q, want %q", got, raw)
+	}
+}
+
+func TestRequest_OrderedParams(t *testing.T) {
+	req := NewRequest("http://127.0.0.1/", "GET").
+		OrderedParams().
+		Param("z", "1").
+		Param("a", "2").
+		Param("m", "x y").
+		Param("z", "3")
+
+	if got, want := req.URL().RawQuery, "z=1&z=3&a=2&m=x+y"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+
+	req = NewRequest("http://127.0.0.1/", "GET").
+		Param("z", "1").
+		Param("a", "2")
+	if got, want := req.URL().RawQuery, "a=2&z=1"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+}
+
+func TestRequest_Signer(t *testing.T) {
+	key := []byte("secret")
+	sign := func(method, path string, body []byte) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(method + "\n" + path + "\n"))
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Signature") != sign(r.Method, r.URL.Path, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "POST").
+		Prefix("sign").
+		Body(strings.NewReader(`{"hello": "world"}`)).
+		Signer(func(req *http.Request) error {
+			rc, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadAll(rc)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("X-Signature", sign(req.Method, req.URL.Path, data))
+			return nil
+		}).
+		Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != `{"hello": "world"}` {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestRequest_TeeResponseBody(t *testing.T) {
+	const payload = `{"hello": "world"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+
+	var audit bytes.Buffer
+	var res map[string]string
+	if err := NewRequest(srv.URL, "GET").TeeResponseBody(&audit).Do().Into(&res); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if audit.String() != payload {
+		t.Errorf("tee = %q, want %q", audit.String(), payload)
+	}
+	if res["hello"] != "world" {
+		t.Errorf("res = %v", res)
+	}
+}
+
+func benchmarkSlurpSize(b *testing.B, slurpSize int64) {
+	var conns int64
+	var attempt int
+	errBody := bytes.Repeat([]byte("x"), 1<<20)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt++
+		if attempt%2 == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(errBody)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewRequest(srv.URL, "GET").HttpClient(client).MaxBodySlurpSize(slurpSize).Do().Raw(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+}
+
+func BenchmarkRequest_MaxBodySlurpSize_Default(b *testing.B) {
+	benchmarkSlurpSize(b, 0)
+}
+
+func BenchmarkRequest_MaxBodySlurpSize_2MB(b *testing.B) {
+	benchmarkSlurpSize(b, 2<<20)
+}
+
+func TestRequest_TLSSessionCache(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS.DidResume {
+			_, _ = w.Write([]byte("resumed"))
+			return
+		}
+		_, _ = w.Write([]byte("new"))
+	}))
+	defer srv.Close()
+
+	cache := tls.NewLRUClientSessionCache(8)
+	for i, want := range []string{"new", "resumed"} {
+		body, err := NewRequest(srv.URL, "GET").TLSSessionCache(cache).Do().Raw()
+		if err != nil {
+			t.Fatal("err", err.Error())
+		}
+		if string(body) != want {
+			t.Errorf("request %d: got %q, want %q", i, body, want)
+		}
+		// requests with the same TLS options share a transport, so drop the
+		// connection to make the next one handshake again.
+		srv.CloseClientConnections()
+	}
+}
+
+func TestRequest_TLSVersion(t *testing.T) {
+	legacy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	legacy.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	legacy.StartTLS()
+	defer legacy.Close()
+
+	if _, err := NewRequest(legacy.URL, "GET").TLSVersion(tls.VersionTLS12, 0).Do().Raw(); err == nil {
+		t.Error("expected the handshake with a TLS 1.1 server to fail")
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS.Version != tls.VersionTLS13 {
+			t.Errorf("version = %#x", r.TLS.Version)
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := NewRequest(srv.URL, "GET").TLSVersion(tls.VersionTLS13, tls.VersionTLS13).Do().Raw(); err != nil {
+		t.Error("err", err.Error())
+	}
+}
+
+func TestRequest_TLSServerName(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.ServerName))
+	}))
+	defer srv.Close()
+
+	// the test certificate is valid for example.com, verification is on.
+	body, err := NewRequest(srv.URL, "GET").
+		HttpClient(srv.Client()).
+		TLSServerName("example.com").
+		Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "example.com" {
+		t.Errorf("server name = %q", body)
+	}
+
+	if _, err := NewRequest(srv.URL, "GET").
+		HttpClient(srv.Client()).
+		TLSServerName("other.test").
+		Do().Raw(); err == nil {
+		t.Error("expected a certificate name mismatch")
+	}
+}
+
+func TestRequest_UseNumber(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id": 9007199254740993}`))
+	}))
+	defer srv.Close()
+
+	var res map[string]interface{}
+	if err := NewRequest(srv.URL, "GET").UseNumber().Do().Into(&res); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	id, ok := res["id"].(json.Number)
+	if !ok {
+		t.Fatalf("id is %T, want json.Number", res["id"])
+	}
+	if n, err := id.Int64(); err != nil || n != 9007199254740993 {
+		t.Errorf("id = %v, %v", n, err)
+	}
+}
+
+func TestRegisterUnmarshaler(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"hello": "world"}`))
+	}))
+	defer srv.Close()
+
+	var calls int
+	RegisterUnmarshaler("application/json", func(data []byte, v interface{}) error {
+		calls++
+		return json.Unmarshal(data, v)
+	})
+	defer RegisterUnmarshaler("application/json", json.Unmarshal)
+
+	var res map[string]string
+	if err := NewRequest(srv.URL, "GET").Do().Into(&res); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if calls != 1 {
+		t.Errorf("custom unmarshaler called %d times", calls)
+	}
+	if res["hello"] != "world" {
+		t.Errorf("res = %v", res)
+	}
+}
+
+func TestResult_IntoUnexpectedMediaType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html><body>maintenance</body></html>"))
+	}))
+	defer srv.Close()
+
+	var res map[string]interface{}
+	err := NewRequest(srv.URL, "GET").Do().Into(&res)
+	if err == nil {
+		t.Fatal("expected an error decoding an html body")
+	}
+	if !strings.Contains(err.Error(), "text/html") || !strings.Contains(err.Error(), "application/json") {
+		t.Errorf("err = %q", err.Error())
+	}
+}
+
+func TestResult_IntoStructuredSuffix(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		_, _ = w.Write([]byte(`{"title": "ok"}`))
+	}))
+	defer srv.Close()
+
+	var res map[string]string
+	if err := NewRequest(srv.URL, "GET").Do().Into(&res); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if res["title"] != "ok" {
+		t.Errorf("res = %v", res)
+	}
+}
+
+func TestRequest_HTTPRequest(t *testing.T) {
+	req, err := NewRequest("http://127.0.0.1:8080/api", "put").
+		Prefix("users", "1").
+		Param("a", "b").
+		Header("X-Test", "yes").
+		Body([]byte(`{"hello": "world"}`)).
+		HTTPRequest()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if req.Method != "PUT" {
+		t.Errorf("method = %q", req.Method)
+	}
+	if got := req.URL.String(); got != "http://127.0.0.1:8080/api/users/1?a=b" {
+		t.Errorf("url = %q", got)
+	}
+	if req.Header.Get("X-Test") != "yes" {
+		t.Errorf("header = %q", req.Header.Get("X-Test"))
+	}
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != `{"hello": "world"}` {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestRequest_Timeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer srv.Close()
+
+	query, err := NewRequest(srv.URL, "GET").Timeout(time.Second).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if len(query) != 0 {
+		t.Errorf("query = %q, want no timeout param", query)
+	}
+
+	query, err = NewRequest(srv.URL, "GET").Timeout(time.Second).TimeoutQueryParam().Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(query) != "timeout=1s" {
+		t.Errorf("query = %q", query)
+	}
+
+	if _, err := NewRequest(srv.URL, "GET").Prefix("slow").Timeout(20 * time.Millisecond).Do().Raw(); err == nil {
+		t.Error("expected the slow request to time out")
+	}
+}
+
+func TestNewRequest_BaseURL(t *testing.T) {
+	for _, c := range []struct {
+		baseUrl, want, host string
+	}{
+		{"https://[::1]:8443/", "https://[::1]:8443/api", "::1"},
+		{"[::1]:8080", "http://[::1]:8080/api", "::1"},
+		{"http://[fe80::1%25en0]/", "http://[fe80::1%25en0]/api", "fe80::1%en0"},
+		{"example.com/https/v1", "http://example.com/https/v1/api", "example.com"},
+		{"localhost:8080", "http://localhost:8080/api", "localhost"},
+	} {
+		u := NewRequest(c.baseUrl, "GET").Prefix("api").URL()
+		if u.String() != c.want {
+			t.Errorf("%s: url = %q, want %q", c.baseUrl, u.String(), c.want)
+		}
+		if u.Hostname() != c.host {
+			t.Errorf("%s: host = %q, want %q", c.baseUrl, u.Hostname(), c.host)
+		}
+	}
+}
+
+func TestNewRequest_InvalidBaseURL(t *testing.T) {
+	req := NewRequest("http://[::1", "GET").AbsPath("api").Prefix("users")
+	if err := req.Do().Error(); err == nil {
+		t.Error("expected the parse error of the base url")
+	}
+	if _, err := req.HTTPRequest(); err == nil {
+		t.Error("expected the parse error from HTTPRequest")
+	}
+}
+
+func TestNewRequest_SchemeDetection(t *testing.T) {
+	req := NewRequest("http://host/path?next=https://evil", "GET")
+	if req.URL().Scheme != "http" {
+		t.Errorf("scheme = %q", req.URL().Scheme)
+	}
+	if req.client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify {
+		t.Error("verification must stay on for http base urls")
+	}
+
+	req = NewRequest("https://host/", "GET")
+	if req.URL().Scheme != "https" {
+		t.Errorf("scheme = %q", req.URL().Scheme)
+	}
+}
+
+func TestResult_StatusPredicates(t *testing.T) {
+	for _, c := range []struct {
+		code                          int
+		success, clientErr, serverErr bool
+	}{
+		{0, false, false, false},
+		{http.StatusOK, true, false, false},
+		{http.StatusNoContent, true, false, false},
+		{http.StatusNotModified, false, false, false},
+		{http.StatusNotFound, false, true, false},
+		{http.StatusTooManyRequests, false, true, false},
+		{http.StatusInternalServerError, false, false, true},
+		{http.StatusServiceUnavailable, false, false, true},
+	} {
+		res := Result{statusCode: c.code}
+		if res.IsSuccess() != c.success || res.IsClientError() != c.clientErr || res.IsServerError() != c.serverErr {
+			t.Errorf("%d: success = %v, client error = %v, server error = %v",
+				c.code, res.IsSuccess(), res.IsClientError(), res.IsServerError())
+		}
+	}
+}
+
+func TestRequest_Use(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	var trace []string
+	mw := func(name string) Middleware {
+		return func(next RoundTripFunc) RoundTripFunc {
+			return func(req *http.Request) (*http.Response, error) {
+				trace = append(trace, name+">")
+				resp, err := next(req)
+				trace = append(trace, "<"+name)
+				return resp, err
+			}
+		}
+	}
+
+	if _, err := NewRequest(srv.URL, "GET").Use(mw("a"), mw("b")).Do().Raw(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	want := "a> b> <b <a a> b> <b <a"
+	if got := strings.Join(trace, " "); got != want {
+		t.Errorf("trace = %q, want %q", got, want)
+	}
+}
+
+func TestRequest_OnUnauthorized(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer fresh" || string(body) != "payload" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	var refreshes int
+	body, err := NewRequest(srv.URL, "POST").
+		Header("Authorization", "Bearer stale").
+		Body([]byte("payload")).
+		OnUnauthorized(func(ctx context.Context) (string, error) {
+			refreshes++
+			return "fresh", nil
+		}).
+		Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "ok" || refreshes != 1 || calls != 2 {
+		t.Errorf("body = %q, refreshes = %d, calls = %d", body, refreshes, calls)
+	}
+
+	// a refreshed token that is rejected as well is not refreshed again.
+	calls, refreshes = 0, 0
+	res := NewRequest(srv.URL, "POST").
+		Body([]byte("payload")).
+		OnUnauthorized(func(ctx context.Context) (string, error) {
+			refreshes++
+			return "still-stale", nil
+		}).
+		Do()
+	if res.HttpStatusCode() != http.StatusUnauthorized || refreshes != 1 || calls != 2 {
+		t.Errorf("status = %d, refreshes = %d, calls = %d", res.HttpStatusCode(), refreshes, calls)
+	}
+}
+
+func TestRequest_SingleFlight(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	var group singleflight.Group
+	var wg sync.WaitGroup
+	var started sync.WaitGroup
+	bodies := make([]string, 10)
+	coalesced := make([]bool, 10)
+	for i := range bodies {
+		wg.Add(1)
+		started.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := NewRequest(srv.URL, "GET").Param("a", "b").SingleFlight(&group)
+			started.Done()
+			res := req.Do()
+			body, _ := res.Raw()
+			bodies[i] = string(body)
+			coalesced[i] = res.Coalesced()
+		}(i)
+	}
+	started.Wait()
+	// give every goroutine the chance to join the flight before it lands.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handler ran %d times", n)
+	}
+	for i, body := range bodies {
+		if body != "ok" || !coalesced[i] {
+			t.Errorf("body %d = %q, coalesced %v", i, body, coalesced[i])
+		}
+	}
+	if NewRequest(srv.URL, "GET").Do().Coalesced() {
+		t.Error("a request without SingleFlight should not be coalesced")
+	}
+}
+
+func TestRequest_SingleFlightCredentials(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer srv.Close()
+
+	var group singleflight.Group
+	var wg sync.WaitGroup
+	tokens := []string{"Bearer alice", "Bearer bob", "Bearer alice"}
+	bodies := make([]string, len(tokens))
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			body, _ := NewRequest(srv.URL, "GET").Header("Authorization", token).SingleFlight(&group).Do().Raw()
+			bodies[i] = string(body)
+		}(i, token)
+	}
+	// give every goroutine the chance to join its flight before it lands.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("handler ran %d times, want once per token", n)
+	}
+	for i, body := range bodies {
+		if body != tokens[i] {
+			t.Errorf("caller %d got the response of %q", i, body)
+		}
+	}
+}
+
+func TestResult_CookieAndHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		w.Header().Set("X-Request-Id", "42")
+	}))
+	defer srv.Close()
+
+	res := NewRequest(srv.URL, "GET").Do()
+	if err := res.Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if cookie, ok := res.Cookie("theme"); !ok || cookie.Value != "dark" {
+		t.Errorf("cookie = %v, %v", cookie, ok)
+	}
+	if cookie, ok := res.Cookie("missing"); ok || cookie != nil {
+		t.Errorf("cookie = %v, %v", cookie, ok)
+	}
+	if got := res.Header("x-request-id"); got != "42" {
+		t.Errorf("header = %q", got)
+	}
+	if got := res.Header("X-Missing"); got != "" {
+		t.Errorf("header = %q", got)
+	}
+}
+
+func TestRequest_Cookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := r.Cookie("session")
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		theme, _ := r.Cookie("theme")
+		_, _ = w.Write([]byte(session.Value + "," + theme.Value))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "GET").
+		Cookie(&http.Cookie{Name: "session", Value: "abc"}).
+		Cookies(&http.Cookie{Name: "theme", Value: "dark"}).
+		Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "abc,dark" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestRequest_MaxResponseHeaderBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Flood", strings.Repeat("x", 64<<10))
+	}))
+	defer srv.Close()
+
+	if _, err := NewRequest(srv.URL, "GET").MaxResponseHeaderBytes(1 << 10).Do().Raw(); err == nil {
+		t.Error("expected oversized headers to be rejected")
+	}
+	if _, err := NewRequest(srv.URL, "GET").MaxResponseHeaderBytes(1 << 20).Do().Raw(); err != nil {
+		t.Error("err", err.Error())
+	}
+}
+
+func TestRequest_ResetParamsAndHeaders(t *testing.T) {
+	req := NewRequest("http://127.0.0.1/", "GET").
+		Param("a", "1").
+		RawQuery("b=2").
+		Header("X-Test", "yes")
+
+	req.ResetParams().ResetHeaders()
+	if len(req.params) != 0 || len(req.headers) != 0 || req.URL().RawQuery != "" {
+		t.Errorf("params = %v, headers = %v, query = %q", req.params, req.headers, req.URL().RawQuery)
+	}
+
+	req.Param("c", "3").Header("X-Other", "no")
+	if got := req.URL().RawQuery; got != "c=3" {
+		t.Errorf("query = %q", got)
+	}
+	if len(req.headers) != 1 || req.headers.Get("X-Other") != "no" {
+		t.Errorf("headers = %v", req.headers)
+	}
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func TestResult_IntoError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/ok" {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(`{"code": 1001, "message": "name already taken"}`))
+	}))
+	defer srv.Close()
+
+	err := NewRequest(srv.URL, "POST").Do().IntoError(&apiError{})
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		t.Fatalf("err = %#v, want *apiError", err)
+	}
+	if apiErr.Code != 1001 || apiErr.Message != "name already taken" {
+		t.Errorf("err = %+v", apiErr)
+	}
+
+	if err := NewRequest(srv.URL, "POST").Prefix("ok").Do().IntoError(&apiError{}); err != nil {
+		t.Errorf("err = %v", err)
+	}
+}
+
+type config struct {
+	Name     string   `yaml:"name" xml:"name"`
+	Replicas int      `yaml:"replicas" xml:"replicas"`
+	Ports    []int    `yaml:"ports" xml:"ports>port"`
+	Labels   []string `yaml:"labels,omitempty" xml:"-"`
+}
+
+// echoServer responds with the request body and Content-Type.
+func echoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		_, _ = io.Copy(w, r.Body)
+	}))
+}
+
+func TestRequest_YAMLBody(t *testing.T) {
+	srv := echoServer()
+	defer srv.Close()
+
+	in := config{Name: "web", Replicas: 3, Ports: []int{80, 443}, Labels: []string{"a", "b"}}
+	var out config
+	if err := NewRequest(srv.URL, "PUT").YAMLBody(in).Do().Into(&out); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("out = %+v, want %+v", out, in)
+	}
+}
+
+func TestRequest_XMLBody(t *testing.T) {
+	var raw string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		raw = string(body)
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	type service struct {
+		XMLName xml.Name `xml:"service"`
+		config
+	}
+	in := service{config: config{Name: "web", Replicas: 3, Ports: []int{80, 443}}}
+	var out service
+	if err := NewRequest(srv.URL, "PUT").XMLBody(in, true).Do().Into(&out); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if !strings.HasPrefix(raw, xml.Header+"<service>") {
+		t.Errorf("body = %q", raw)
+	}
+	if !reflect.DeepEqual(in.config, out.config) {
+		t.Errorf("out = %+v, want %+v", out.config, in.config)
+	}
+}
+
+func TestResult_WriteTo(t *testing.T) {
+	const payload = "hello world"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	n, err := NewRequest(srv.URL, "GET").Do().WriteTo(&buf)
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if n != int64(len(payload)) || buf.String() != payload {
+		t.Errorf("n = %d, body = %q", n, buf.String())
+	}
+}
+
+func TestRequest_BodyBytes(t *testing.T) {
+	const payload = `{"hello": "world"}`
+	srv := echoServer()
+	defer srv.Close()
+
+	for name, body := range map[string]io.Reader{
+		"seekable":     strings.NewReader(payload),
+		"non-seekable": io.MultiReader(strings.NewReader(payload)),
+	} {
+		req := NewRequest(srv.URL, "POST").Body(body)
+		data, err := req.BodyBytes()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(data) != payload {
+			t.Errorf("%s: body bytes = %q", name, data)
+		}
+
+		sent, err := req.Do().Raw()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(sent) != payload {
+			t.Errorf("%s: sent = %q", name, sent)
+		}
+	}
+}
+
+func TestRequest_AbsoluteURL(t *testing.T) {
+	var got string
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.String() + " " + r.Header.Get("X-Test")
+	}))
+	defer second.Close()
+
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(second.URL + "/jobs/1?watch=true"))
+	}))
+	defer first.Close()
+
+	req := NewRequest(first.URL, "GET").Prefix("jobs").Param("a", "b").Header("X-Test", "yes")
+	location, err := req.Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if _, err := req.AbsoluteURL(string(location)).Do().Raw(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if got != "/jobs/1?watch=true yes" {
+		t.Errorf("second server got %q", got)
+	}
+
+	if err := NewRequest(first.URL, "GET").AbsoluteURL("/relative").Do().Error(); err == nil {
+		t.Error("expected a relative url to be rejected")
+	}
+}
+
+func TestRequest_TimeoutError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	err := NewRequest(srv.URL, "GET").Timeout(20 * time.Millisecond).Do().Error()
+	if !IsTimeout(err) {
+		t.Fatalf("err = %#v, want a timeout", err)
+	}
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Errorf("err = %#v, want *TimeoutError", err)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("err = %#v, want a net.Error timeout", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := NewRequest(srv.URL, "GET").Context(ctx).Stream(); !IsTimeout(err) {
+		t.Errorf("stream err = %#v, want a timeout", err)
+	}
+
+	if IsTimeout(errors.New("boom")) {
+		t.Error("plain errors are not timeouts")
+	}
+}
+
+func TestResult_DecodeAs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte(`{"hello": "world"}`))
+	}))
+	defer srv.Close()
+
+	res := NewRequest(srv.URL, "GET").Do()
+	var out map[string]string
+	if err := res.Into(&out); err == nil {
+		t.Error("expected Into to reject application/octet-stream")
+	}
+	if err := res.DecodeAs(&out, "application/json"); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if out["hello"] != "world" {
+		t.Errorf("out = %v", out)
+	}
+}
+
+func TestRequest_BodyReader(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	f, err := ioutil.TempFile("", "request-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.ContentLength != info.Size() || len(r.TransferEncoding) != 0 {
+			t.Errorf("content length = %d, transfer encoding = %v", r.ContentLength, r.TransferEncoding)
+		}
+		if !bytes.Equal(body, payload) {
+			t.Errorf("got %d bytes", len(body))
+		}
+	}))
+	defer srv.Close()
+
+	// hide the *os.File so that the transport cannot infer the length itself.
+	body := struct{ io.Reader }{f}
+	if err := NewRequest(srv.URL, "PUT").BodyReader(body, info.Size()).Do().Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+}
+
+func TestRequest_Pathf(t *testing.T) {
+	req := NewRequest("http://127.0.0.1/api", "GET").Pathf("/users/%d/posts/%d", 42, 7)
+	if got := req.URL().String(); got != "http://127.0.0.1/api/users/42/posts/7" {
+		t.Errorf("url = %q", got)
+	}
+
+	var rawPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawPath = r.URL.EscapedPath()
+	}))
+	defer srv.Close()
+
+	if err := NewRequest(srv.URL, "GET").Pathf("files/%s", "a b/c").Do().Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if rawPath != "/files/a%20b%2Fc" {
+		t.Errorf("path = %q", rawPath)
+	}
+}
+
+func TestRequest_PathfEscapedSegments(t *testing.T) {
+	var rawPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawPath = r.URL.EscapedPath()
+	}))
+	defer srv.Close()
+
+	// a literal % in Prefix or AbsPath is sent escaped, as before Pathf.
+	for _, req := range []*Request{
+		NewRequest(srv.URL, "GET").Prefix("100%25"),
+		NewRequest(srv.URL, "GET").AbsPath("100%25"),
+	} {
+		if err := req.Do().Error(); err != nil {
+			t.Fatal("err", err.Error())
+		}
+		if rawPath != "/100%2525" {
+			t.Errorf("path = %q", rawPath)
+		}
+	}
+
+	// segments escaped by Pathf survive later path changes and a new base url.
+	req := NewRequest("http://127.0.0.1/api", "GET").Pathf("files/%s", "a/b").Prefix("x y").BaseURL(srv.URL + "/v2")
+	if err := req.Do().Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if rawPath != "/v2/files/a%2Fb/x%20y" {
+		t.Errorf("path = %q", rawPath)
+	}
+
+	for _, segment := range []string{".", ".."} {
+		if err := NewRequest(srv.URL, "GET").Pathf("files/%s/secret", segment).Do().Error(); err == nil {
+			t.Errorf("%q: expected an error", segment)
+		}
+	}
+}
+
+func TestRequest_MethodOverride(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Method + " " + r.Header.Get("X-HTTP-Method-Override")))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "DELETE").MethodOverride().Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "POST DELETE" {
+		t.Errorf("server saw %q", body)
+	}
+
+	body, _ = NewRequest(srv.URL, "GET").MethodOverride().Do().Raw()
+	if string(body) != "GET " {
+		t.Errorf("server saw %q", body)
+	}
+}
+
+func TestResult_TLSState(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	state := NewRequest(srv.URL, "GET").Do().TLSState()
+	if state == nil || len(state.PeerCertificates) == 0 {
+		t.Fatalf("state = %+v", state)
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.Subject.Organization) == 0 || cert.Subject.Organization[0] != "Acme Co" {
+		t.Errorf("subject = %v", cert.Subject)
+	}
+	if state.Version < tls.VersionTLS12 || cert.NotAfter.IsZero() {
+		t.Errorf("version = %#x, not after = %v", state.Version, cert.NotAfter)
+	}
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	if state := NewRequest(plain.URL, "GET").Do().TLSState(); state != nil {
+		t.Errorf("plain http state = %+v", state)
+	}
+}
+
+func TestRequest_TimeoutAndContextDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	for name, c := range map[string]struct {
+		ctxTimeout, timeout time.Duration
+	}{
+		"context deadline first": {30 * time.Millisecond, 5 * time.Second},
+		"timeout first":          {5 * time.Second, 30 * time.Millisecond},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), c.ctxTimeout)
+		start := time.Now()
+		err := NewRequest(srv.URL, "GET").Context(ctx).Timeout(c.timeout).Do().Error()
+		elapsed := time.Since(start)
+		cancel()
+
+		if !IsTimeout(err) {
+			t.Errorf("%s: err = %v, want a timeout", name, err)
+		}
+		if elapsed > 500*time.Millisecond {
+			t.Errorf("%s: took %v, the earlier deadline did not win", name, elapsed)
+		}
+	}
+}
+
+type countingCloser struct {
+	closes int
+}
+
+func (c *countingCloser) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestResult_Close(t *testing.T) {
+	srv := echoServer()
+	defer srv.Close()
+
+	res := NewRequest(srv.URL, "POST").Body([]byte("hello")).Do()
+	for i := 0; i < 2; i++ {
+		if err := res.Close(); err != nil {
+			t.Errorf("close %d: %v", i, err)
+		}
+	}
+	if body, err := res.Raw(); err != nil || string(body) != "hello" {
+		t.Errorf("body = %q, err = %v", body, err)
+	}
+
+	closer := &countingCloser{}
+	res = Result{closer: &onceCloser{closer: closer}}
+	copied := res
+	_ = res.Close()
+	_ = copied.Close()
+	if closer.closes != 1 {
+		t.Errorf("closed %d times", closer.closes)
+	}
+}
+
+func TestRequest_DryRun(t *testing.T) {
+	dump, err := NewRequest("http://example.com", "POST").Prefix("users").
+		Header("Content-Type", "application/json").Header("X-Trace", "abc").
+		Body([]byte(`{"name":"alice"}`)).DryRun()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	want := "POST /users HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Content-Type: application/json\r\n" +
+		"X-Trace: abc\r\n" +
+		"\r\n" +
+		`{"name":"alice"}`
+	if dump != want {
+		t.Errorf("dump = %q, want %q", dump, want)
+	}
+}
+
+type correlationKey struct{}
+
+func TestRequest_CorrelationHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Correlation-ID")))
+	}))
+	defer srv.Close()
+
+	ctx := context.WithValue(context.Background(), correlationKey{}, "abc-123")
+	body, err := NewRequest(srv.URL, "GET").Context(ctx).
+		CorrelationHeader("X-Correlation-ID", correlationKey{}).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "abc-123" {
+		t.Errorf("header = %q", body)
+	}
+
+	body, _ = NewRequest(srv.URL, "GET").CorrelationHeader("X-Correlation-ID", correlationKey{}).Do().Raw()
+	if len(body) != 32 {
+		t.Errorf("generated header = %q", body)
+	}
+
+	for _, key := range []interface{}{nil, []string{"id"}} {
+		if err := NewRequest(srv.URL, "GET").CorrelationHeader("X-Correlation-ID", key).Do().Error(); err == nil {
+			t.Errorf("expected an error for the context key %#v", key)
+		}
+	}
+}
+
+func TestRequest_MaxRetryAfter(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	body, err := NewRequest(srv.URL, "GET").MaxRetryAfter(100 * time.Millisecond).Do().Raw()
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "ok" || calls != 2 {
+		t.Errorf("body = %q after %d calls", body, calls)
+	}
+	if elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("waited %v, want between 50ms and 100ms", elapsed)
+	}
+}
+
+func TestRequest_DefaultMaxRetryAfter(t *testing.T) {
+	day := 24 * time.Hour
+	if d := NewRequest("http://127.0.0.1/", "GET").retryAfter(86400); d < defaultMaxRetryAfter/2 || d > defaultMaxRetryAfter {
+		t.Errorf("default: waiting %v", d)
+	}
+	if d := NewRequest("http://127.0.0.1/", "GET").MaxRetryAfter(2 * day).retryAfter(86400); d != day {
+		t.Errorf("raised cap: waiting %v", d)
+	}
+	if d := NewRequest("http://127.0.0.1/", "GET").MaxRetryAfter(-1).retryAfter(86400); d != day {
+		t.Errorf("no cap: waiting %v", d)
+	}
+	if d := NewRequest("http://127.0.0.1/", "GET").retryAfter(1); d != time.Second {
+		t.Errorf("short delay: waiting %v", d)
+	}
+}
+
+func TestRequest_JSONBody(t *testing.T) {
+	srv := echoServer()
+	defer srv.Close()
+
+	v := map[string]string{"q": "a<b && c>d"}
+	body, err := NewRequest(srv.URL, "POST").JSONBody(v, nil).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != `{"q":"a\u003cb \u0026\u0026 c\u003ed"}` {
+		t.Errorf("body = %s", body)
+	}
+
+	body, err = NewRequest(srv.URL, "POST").JSONBody(v, &JSONOptions{DisableHTMLEscape: true}).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != `{"q":"a<b && c>d"}` {
+		t.Errorf("body = %s", body)
+	}
+
+	body, _ = NewRequest(srv.URL, "POST").JSONBody(v, &JSONOptions{Indent: "  "}).Do().Raw()
+	if string(body) != "{\n  \"q\": \"a\\u003cb \\u0026\\u0026 c\\u003ed\"\n}" {
+		t.Errorf("indented body = %s", body)
+	}
+}
+
+func TestRequest_ResponseObserver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	type observation struct {
+		method, host string
+		status       int
+		dur          time.Duration
+	}
+	var seen []observation
+	observe := func(method, host string, status int, dur time.Duration) {
+		seen = append(seen, observation{method, host, status, dur})
+	}
+
+	_ = NewRequest(srv.URL, "DELETE").ResponseObserver(observe).Do()
+	_ = NewRequest(srv.URL, "GET").Do()
+	if len(seen) != 1 {
+		t.Fatalf("observed %d times", len(seen))
+	}
+	o := seen[0]
+	if o.method != "DELETE" || "http://"+o.host != srv.URL || o.status != http.StatusNotFound {
+		t.Errorf("observed %+v", o)
+	}
+	if o.dur < 20*time.Millisecond || o.dur > time.Second {
+		t.Errorf("duration = %v", o.dur)
+	}
+}
+
+func TestRequest_PropagateDeadlineHeader(t *testing.T) {
+	var seen []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, _ := strconv.Atoi(r.Header.Get("X-Request-Timeout"))
+		seen = append(seen, ms)
+		time.Sleep(50 * time.Millisecond)
+		if len(seen) < 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	err := NewRequest(srv.URL, "GET").Timeout(5 * time.Second).
+		PropagateDeadlineHeader("X-Request-Timeout").Do().Error()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if len(seen) != 2 {
+		t.Fatalf("seen = %v", seen)
+	}
+	if seen[0] > 5000 || seen[0] < 4000 || seen[1] > seen[0]-50 {
+		t.Errorf("deadline header did not shrink: %v", seen)
+	}
+}
+
+func TestResult_Validate(t *testing.T) {
+	payload := []byte(`{"name":"alice"}`)
+	sum := sha256.Sum256(payload)
+	tampered := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Checksum", hex.EncodeToString(sum[:]))
+		if tampered {
+			_, _ = w.Write([]byte(`{"name":"mallory"}`))
+			return
+		}
+		_, _ = w.Write(payload)
+	}))
+	defer srv.Close()
+
+	checksum := func(res Result) func([]byte) error {
+		return func(body []byte) error {
+			got := sha256.Sum256(body)
+			if hex.EncodeToString(got[:]) != res.Header("X-Checksum") {
+				return errors.New("checksum mismatch")
+			}
+			return nil
+		}
+	}
+
+	var out map[string]string
+	res := NewRequest(srv.URL, "GET").Do()
+	if err := res.Validate(checksum(res)).Into(&out); err != nil || out["name"] != "alice" {
+		t.Errorf("out = %v, err = %v", out, err)
+	}
+
+	tampered = true
+	out = nil
+	res = NewRequest(srv.URL, "GET").Do()
+	if err := res.Validate(checksum(res)).Into(&out); err == nil || err.Error() != "checksum mismatch" || out != nil {
+		t.Errorf("out = %v, err = %v", out, err)
+	}
+}
+
+func TestRequest_GzipBodyOverThreshold(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		data, _ := ioutil.ReadAll(body)
+		_, _ = w.Write([]byte(r.Header.Get("Content-Encoding") + ":" + strconv.Itoa(len(data))))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "POST").Body([]byte("small")).GzipBodyOverThreshold(1024).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != ":5" {
+		t.Errorf("small body: %s", body)
+	}
+
+	large := bytes.Repeat([]byte("a"), 4096)
+	body, err = NewRequest(srv.URL, "POST").Body(large).GzipBodyOverThreshold(1024).Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "gzip:4096" {
+		t.Errorf("large body: %s", body)
+	}
+}
+
+func TestResult_BodyReader(t *testing.T) {
+	srv := echoServer()
+	defer srv.Close()
+
+	res := NewRequest(srv.URL, "POST").Body([]byte("hello")).Do()
+	for i := 0; i < 2; i++ {
+		data, err := ioutil.ReadAll(res.BodyReader())
+		if err != nil || string(data) != "hello" {
+			t.Errorf("read %d: %q, err = %v", i, data, err)
+		}
+	}
+}
+
+func TestRequest_Trailer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte(strings.Join(r.TransferEncoding, ",") + " " + string(data) + " " + r.Trailer.Get("Grpc-Status")))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "POST").Body([]byte("payload")).Trailer("Grpc-Status", "0").Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "chunked payload 0" {
+		t.Errorf("server saw %q", body)
+	}
+}
+
+func TestRequest_RequestURIKeepsParams(t *testing.T) {
+	got := NewRequest("http://example.com", "GET").Prefix("ignored").
+		Param("a", "1").RequestURI("/v1/items?a=2&b=3").URL()
+	if got.Path != "/v1/items" {
+		t.Errorf("path = %q", got.Path)
+	}
+	if q := got.Query(); !reflect.DeepEqual(q["a"], []string{"1", "2"}) || q.Get("b") != "3" {
+		t.Errorf("query = %v", q)
+	}
+}
+
+func TestRequest_ParamsFromURL(t *testing.T) {
+	u, _ := url.Parse("http://example.com/search?tag=b&page=2")
+
+	got := NewRequest("http://example.com", "GET").Param("tag", "a").ParamsFromURL(u).URL()
+	if got.RawQuery != "page=2&tag=a&tag=b" {
+		t.Errorf("merged url = %s", got)
+	}
+
+	got = NewRequest("http://example.com", "GET").Param("tag", "a").RequestURI(u.RequestURI()).URL()
+	if got.Path != "/search" || got.RawQuery != "page=2&tag=a&tag=b" {
+		t.Errorf("request uri url = %s", got)
+	}
+}
+
+func TestRequest_NonStandardPort(t *testing.T) {
+	var host, serverName string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverName = hello.ServerName
+		return nil, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	var dialed string
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			return net.Dial(network, srv.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	req := NewRequest("https://api.example.com:8443/", "GET").HttpClient(client)
+	if u := req.URL(); u.Host != "api.example.com:8443" {
+		t.Errorf("url host = %q", u.Host)
+	}
+	if err := req.Do().Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if dialed != "api.example.com:8443" {
+		t.Errorf("dialed %q", dialed)
+	}
+	if host != "api.example.com:8443" {
+		t.Errorf("Host = %q", host)
+	}
+	if serverName != "api.example.com" {
+		t.Errorf("SNI = %q", serverName)
+	}
+}
+
+func TestResult_Must(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"alice"}`))
+	}))
+	defer srv.Close()
+
+	var out map[string]string
+	NewRequest(srv.URL, "GET").Do().MustInto(&out)
+	if out["name"] != "alice" {
+		t.Errorf("out = %v", out)
+	}
+	if body := NewRequest(srv.URL, "GET").Do().MustRaw(); string(body) != `{"name":"alice"}` {
+		t.Errorf("body = %s", body)
+	}
+
+	mustPanic := func(name string, fn func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", name)
+			}
+		}()
+		fn()
+	}
+	res := NewRequest(srv.URL, "GET").Prefix("missing").Do()
+	mustPanic("MustInto", func() { res.MustInto(&out) })
+	mustPanic("MustRaw", func() { res.MustRaw() })
+}
+
+func TestFromHTTPRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("X-Trace") + " " + string(data)))
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest("PUT", srv.URL+"/items/a%2Fb?x=1&y=2", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Trace", "abc")
+
+	r := FromHTTPRequest(req)
+	if u := r.URL().String(); u != srv.URL+"/items/a%2Fb?x=1&y=2" {
+		t.Errorf("url = %s", u)
+	}
+	body, err := r.Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "PUT /items/a%2Fb?x=1&y=2 abc payload" {
+		t.Errorf("server saw %q", body)
+	}
+
+	// the original request keeps its body.
+	if data, _ := ioutil.ReadAll(req.Body); string(data) != "payload" {
+		t.Errorf("original body = %q", data)
+	}
+}
+
+func TestFromHTTPRequest_Incoming(t *testing.T) {
+	urls := make(chan string, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urls <- FromHTTPRequest(r).URL().String()
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+
+	for _, base := range []string{srv.URL, tlsSrv.URL} {
+		if err := NewRequest(base, "GET").Pathf("items/%s", "a").Param("x", "1").Do().Error(); err != nil {
+			t.Fatal("err", err.Error())
+		}
+		if u := <-urls; u != base+"/items/a?x=1" {
+			t.Errorf("url = %s, want %s/items/a?x=1", u, base)
+		}
+	}
+}
+
+func TestRequest_Languages(t *testing.T) {
+	req, err := NewRequest("http://example.com", "POST").
+		AcceptLanguage("de-CH", "de;q=0.9", "en;q=0.8").
+		ContentLanguage("en", "fr").HTTPRequest()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if got := req.Header.Get("Accept-Language"); got != "de-CH, de;q=0.9, en;q=0.8" {
+		t.Errorf("Accept-Language = %q", got)
+	}
+	if got := req.Header.Get("Content-Language"); got != "en, fr" {
+		t.Errorf("Content-Language = %q", got)
+	}
+}
+
+func TestNewRequest_TLSVerifyEnv(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	if err := NewRequest(srv.URL, "GET").Do().Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+
+	os.Setenv("REQUEST_TLS_VERIFY", "1")
+	defer os.Unsetenv("REQUEST_TLS_VERIFY")
+	err := NewRequest(srv.URL, "GET").Do().Error()
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("err = %v, want a certificate error", err)
+	}
+}
+
+// withDecoder sets the decoder of r directly.
+func withDecoder(r *Request, d Decoder) *Request {
+	r.decoder = d
+	return r
+}
+
+// slowDecoder decodes one byte per millisecond.
+type slowDecoder struct{}
+
+func (slowDecoder) Decode(data []byte, mediaType string, into interface{}) (interface{}, error) {
+	return slowDecoder{}.DecodeContext(context.Background(), data, mediaType, into)
+}
+
+func (slowDecoder) DecodeContext(ctx context.Context, data []byte, mediaType string, into interface{}) (interface{}, error) {
+	for range data {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return into, nil
+}
+
+func TestResult_IntoContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bytes.Repeat([]byte(" "), 10000))
+	}))
+	defer srv.Close()
+
+	res := withDecoder(NewRequest(srv.URL, "GET"), slowDecoder{}).Do()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	var out interface{}
+	start := time.Now()
+	err := res.IntoContext(ctx, &out)
+	if err != context.DeadlineExceeded {
+		t.Errorf("err = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("decoding was not cancelled, took %v", elapsed)
+	}
+}
+
+func TestRequest_ErrorOnStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("queued"))
+	}))
+	defer srv.Close()
+
+	if err := NewRequest(srv.URL, "POST").Do().Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+
+	var status int
+	err := NewRequest(srv.URL, "POST").ErrorOnStatus(http.StatusAccepted).Do().StatusCode(&status).Error()
+	if err == nil || status != http.StatusAccepted {
+		t.Errorf("status = %d, err = %v", status, err)
+	}
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func TestRequest_CapErrorBody(t *testing.T) {
+	page := bytes.Repeat([]byte("x"), 8<<20)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write(page)
+	}))
+	defer srv.Close()
+
+	var read int64
+	count := func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			resp, err := next(req)
+			if err == nil {
+				resp.Body = countingReadCloser{ReadCloser: resp.Body, n: &read}
+			}
+			return resp, err
+		}
+	}
+
+	body, err := NewRequest(srv.URL, "GET").Use(count).CapErrorBody().Do().Raw()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(body) != maxUnstructuredResponseTextBytes || read > 2*maxUnstructuredResponseTextBytes {
+		t.Errorf("kept %d bytes, read %d", len(body), read)
+	}
+
+	read = 0
+	body, _ = NewRequest(srv.URL, "GET").Use(count).Do().Raw()
+	if len(body) != len(page) || read != int64(len(page)) {
+		t.Errorf("uncapped: kept %d bytes, read %d", len(body), read)
+	}
+}
+
+func TestResult_IntoStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_, _ = w.Write([]byte(`{"name":"alice"}` + "\n" + `{"name":"bob"}`))
+	}))
+	defer srv.Close()
+
+	type user struct {
+		Name string `json:"name"`
+	}
+	var users []user
+	if err := NewRequest(srv.URL, "GET").Do().IntoStream(&users); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if !reflect.DeepEqual(users, []user{{"alice"}, {"bob"}}) {
+		t.Errorf("users = %+v", users)
+	}
+
+	if err := NewRequest(srv.URL, "GET").Do().IntoStream(users); err == nil {
+		t.Error("expected an error for a non-pointer")
+	}
+}
+
+func TestRequest_AllowGetBody(t *testing.T) {
+	srv := echoServer()
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	body, err := NewRequest(srv.URL, "GET").WithLogger(log.New(&buf, "", 0)).Body([]byte("q")).Do().Raw()
+	if err != nil || string(body) != "q" {
+		t.Errorf("body = %q, err = %v", body, err)
+	}
+	if !strings.Contains(buf.String(), "has a body") {
+		t.Errorf("no warning logged: %q", buf.String())
+	}
+
+	// without a logger the warning goes to the standard one.
+	buf.Reset()
+	log.SetOutput(&buf)
+	body, err = NewRequest(srv.URL, "GET").Body([]byte("q")).Do().Raw()
+	log.SetOutput(os.Stderr)
+	if err != nil || string(body) != "q" || !strings.Contains(buf.String(), "has a body") {
+		t.Errorf("default: body = %q, err = %v, log = %q", body, err, buf.String())
+	}
+
+	buf.Reset()
+	body, err = NewRequest(srv.URL, "GET").WithLogger(log.New(&buf, "", 0)).Body([]byte("q")).AllowGetBody(true).Do().Raw()
+	if err != nil || string(body) != "q" || buf.Len() != 0 {
+		t.Errorf("allowed: body = %q, err = %v, log = %q", body, err, buf.String())
+	}
+
+	if err := NewRequest(srv.URL, "GET").Body([]byte("q")).AllowGetBody(false).Do().Error(); err == nil {
+		t.Error("expected a GET body to be rejected")
+	}
+}
+
+func TestRequest_RetryTruncatedBody(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			_, _ = rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+			_ = rw.Flush()
+			conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte("complete"))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "GET").Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "complete" || calls != 2 {
+		t.Errorf("body = %q after %d calls", body, calls)
+	}
+
+	calls = 0
+	if err := NewRequest(srv.URL, "POST").Do().Error(); err == nil || calls != 1 {
+		t.Errorf("POST was retried: %d calls, err = %v", calls, err)
+	}
+}
+
+// onlyReader hides every method of a reader but Read.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestRequest_GzipBodyStreaming(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, err := io.Copy(ioutil.Discard, zr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("retry") != "" && calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write([]byte(strings.Join(r.TransferEncoding, ",") + " " + strconv.FormatInt(n, 10)))
+	}))
+	defer srv.Close()
+
+	large := onlyReader{io.LimitReader(strings.NewReader(strings.Repeat("0123456789", 1<<20)), 8<<20)}
+	body, err := NewRequest(srv.URL, "POST").Body(large).GzipBody().Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if string(body) != "chunked 8388608" {
+		t.Errorf("server saw %q", body)
+	}
+
+	calls = 0
+	err = NewRequest(srv.URL, "POST").Param("retry", "1").
+		Body(onlyReader{strings.NewReader("payload")}).GzipBody().Do().Error()
+	if err == nil || calls != 1 || !strings.Contains(err.Error(), "buffer it with BodyBytes first") {
+		t.Errorf("calls = %d, err = %v", calls, err)
+	}
+	if statusErr := new(StatusError); !errors.As(err, &statusErr) || statusErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("err = %#v, want the 503 status", err)
+	}
+}
+
+func TestRequest_CloseConnection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strconv.FormatBool(r.Close)))
+	}))
+	defer srv.Close()
+
+	if body, _ := NewRequest(srv.URL, "GET").Do().Raw(); string(body) != "false" {
+		t.Errorf("default closes the connection")
+	}
+	if body, _ := NewRequest(srv.URL, "GET").CloseConnection().Do().Raw(); string(body) != "true" {
+		t.Errorf("server did not see Connection: close")
+	}
+}
+
+// recordingDecoder records the media types it is asked to decode.
+type recordingDecoder struct {
+	mediaTypes []string
+}
+
+func (d *recordingDecoder) Decode(data []byte, mediaType string, into interface{}) (interface{}, error) {
+	d.mediaTypes = append(d.mediaTypes, mediaType)
+	return NewDecode().Decode(data, "application/json", into)
+}
+
+func TestRequest_Decoder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.custom; charset=utf-8")
+		_, _ = w.Write([]byte(`{"name":"alice"}`))
+	}))
+	defer srv.Close()
+
+	dec := &recordingDecoder{}
+	var out map[string]string
+	if err := NewRequest(srv.URL, "GET").Decoder(dec).Do().Into(&out); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if out["name"] != "alice" || !reflect.DeepEqual(dec.mediaTypes, []string{"application/vnd.custom"}) {
+		t.Errorf("out = %v, media types = %v", out, dec.mediaTypes)
+	}
+
+	// without it, the media type is rejected by the built-in decoder.
+	if err := NewRequest(srv.URL, "GET").Do().Into(&out); err == nil {
+		t.Error("expected the built-in decoder to reject application/vnd.custom")
+	}
+}
+
+func TestRequest_Purge(t *testing.T) {
+	var verbs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verbs = append(verbs, r.Method)
+		if len(verbs) == 1 {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			_, _ = rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\npurg")
+			_ = rw.Flush()
+			conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte("purged"))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "purge").Prefix("assets", "logo.png").Do().Raw()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	// the truncated response is retried like for any idempotent verb.
+	if string(body) != "purged" || !reflect.DeepEqual(verbs, []string{"PURGE", "PURGE"}) {
+		t.Errorf("body = %q, verbs = %v", body, verbs)
+	}
+}
+
+func TestResult_RetryAfter(t *testing.T) {
+	var retryAfter string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	// MaxRetryAfter keeps the retries before giving up short.
+	retryAfter = "120"
+	d, ok := NewRequest(srv.URL, "GET").MaxRetryAfter(time.Millisecond).Do().RetryAfter()
+	if !ok || d != 120*time.Second {
+		t.Errorf("seconds: %v, %v", d, ok)
+	}
+
+	retryAfter = time.Now().Add(2 * time.Minute).UTC().Format(http.TimeFormat)
+	d, ok = NewRequest(srv.URL, "GET").MaxRetryAfter(time.Millisecond).Do().RetryAfter()
+	if !ok || d <= 110*time.Second || d > 120*time.Second {
+		t.Errorf("date: %v, %v", d, ok)
+	}
+
+	retryAfter = ""
+	if _, ok := NewRequest(srv.URL, "GET").Do().RetryAfter(); ok {
+		t.Error("RetryAfter without the header")
+	}
+}
+
+func TestRequest_RetryDecider(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if calls == 1 {
+			_, _ = w.Write([]byte("temporarily unavailable"))
+			return
+		}
+		_, _ = w.Write([]byte("permanently unavailable"))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "GET").RetryDecider(func(resp *http.Response, body []byte) bool {
+		return !bytes.Contains(body, []byte("permanently"))
+	}).Do().Raw()
+	if err == nil || calls != 2 {
+		t.Errorf("calls = %d, err = %v", calls, err)
+	}
+	if string(body) != "permanently unavailable" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestRequest_IfMatch(t *testing.T) {
+	etag := `"v2"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if match := r.Header.Get("If-Match"); match != "" && match != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	err := NewRequest(srv.URL, "PUT").IfMatch(`"v1"`).Do().Error()
+	if !IsPreconditionFailed(err) {
+		t.Errorf("stale etag: err = %v", err)
+	}
+	if err := NewRequest(srv.URL, "PUT").IfMatch(etag).Do().Error(); err != nil {
+		t.Errorf("current etag: err = %v", err)
+	}
+	if err := NewRequest(srv.URL, "PUT").IfNoneMatch("*").Do().Error(); !IsPreconditionFailed(err) {
+		t.Errorf("existing resource: err = %v", err)
+	}
+	if IsPreconditionFailed(NewGenericServerResponse(http.StatusConflict, "")) {
+		t.Error("a conflict is not a failed precondition")
+	}
+}
+
+func TestRequest_RetryConnectionReset(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			_ = conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	body, err := NewRequest(srv.URL, "BAN").Do().Raw()
+	if n := atomic.LoadInt32(&calls); err != nil || string(body) != "ok" || n != 2 {
+		t.Errorf("BAN: body = %q, err = %v after %d calls", body, err, n)
+	}
+
+	// PUT is idempotent but has a body, so the reset is returned as is.
+	atomic.StoreInt32(&calls, 0)
+	_, err = NewRequest(srv.URL, "PUT").Body([]byte("data")).Do().Raw()
+	if n := atomic.LoadInt32(&calls); !IsConnectionReset(err) || n != 1 {
+		t.Errorf("PUT: err = %v after %d calls", err, n)
+	}
+
+	// a body that cannot be sent again returns the reset, not a made-up 500.
+	atomic.StoreInt32(&calls, 0)
+	_, err = NewRequest(srv.URL, "PURGE").BodyReader(onlyReader{strings.NewReader("data")}, 4).Do().Raw()
+	if n := atomic.LoadInt32(&calls); !IsConnectionReset(err) || n != 1 {
+		t.Errorf("PURGE: err = %v after %d calls", err, n)
+	}
+}
+
+func TestRequest_StreamBuildsLikeDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte(strings.Join([]string{r.Method, r.Header.Get("X-HTTP-Method-Override"), r.Header.Get("X-Signed"), string(body)}, " ")))
+	}))
+	defer srv.Close()
+
+	rc, err := NewRequest(srv.URL, "PATCH").
+		MethodOverride().
+		Signer(func(req *http.Request) error {
+			req.Header.Set("X-Signed", "yes")
+			return nil
+		}).
+		Body([]byte("data")).
+		Stream()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	defer rc.Close()
+	body, _ := ioutil.ReadAll(rc)
+	if string(body) != "POST PATCH yes data" {
+		t.Errorf("body = %q", body)
+	}
+}
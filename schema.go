@@ -0,0 +1,57 @@
+package request
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// SchemaValidationError lists the ways a response body does not conform to
+// a JSON Schema.
+type SchemaValidationError struct {
+	Errors []string
+}
+
+var _ error = &SchemaValidationError{}
+
+// Error implements the Error interface.
+func (e *SchemaValidationError) Error() string {
+	return "the response does not match the schema: " + strings.Join(e.Errors, "; ")
+}
+
+// ValidateSchema validates a JSON response body against a JSON Schema. It
+// returns a *SchemaValidationError describing every violation when the body
+// does not conform.
+func (r Result) ValidateSchema(schema []byte) error {
+	if r.err != nil {
+		return r.Error()
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.contentType)
+	if err != nil {
+		return err
+	}
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return fmt.Errorf("unable to validate a %s response against a JSON schema", mediaType)
+	}
+
+	body, err := r.bodyBytes()
+	if err != nil {
+		return err
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	validationErr := &SchemaValidationError{}
+	for _, desc := range result.Errors() {
+		validationErr.Errors = append(validationErr.Errors, desc.String())
+	}
+	return validationErr
+}
@@ -0,0 +1,41 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResult_ValidateSchema(t *testing.T) {
+	schema := []byte(`{
+		"type": "object",
+		"required": ["id", "name"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string"}
+		}
+	}`)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/valid" {
+			_, _ = w.Write([]byte(`{"id": 1, "name": "kpl"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id": "1"}`))
+	}))
+	defer srv.Close()
+
+	if err := NewRequest(srv.URL, "GET").Prefix("valid").Do().ValidateSchema(schema); err != nil {
+		t.Errorf("err = %v", err)
+	}
+
+	err := NewRequest(srv.URL, "GET").Prefix("invalid").Do().ValidateSchema(schema)
+	validationErr, ok := err.(*SchemaValidationError)
+	if !ok {
+		t.Fatalf("err = %v, want *SchemaValidationError", err)
+	}
+	if len(validationErr.Errors) != 2 {
+		t.Errorf("errors = %q", validationErr.Errors)
+	}
+}
@@ -0,0 +1,86 @@
+package request
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerTiming is a metric of the Server-Timing response header.
+type ServerTiming struct {
+	Name        string
+	Duration    time.Duration
+	Description string
+}
+
+// ServerTimings parses the Server-Timing headers of the response, e.g.
+// `db;dur=53.2, cache;desc="Cache Read";dur=23.2`. Metrics without a
+// duration have a zero Duration; malformed params are skipped.
+func (r Result) ServerTimings() []ServerTiming {
+	var timings []ServerTiming
+	for _, value := range r.headers["Server-Timing"] {
+		for _, metric := range splitQuoted(value, ',') {
+			params := splitQuoted(metric, ';')
+			name := strings.TrimSpace(params[0])
+			if name == "" {
+				continue
+			}
+			timing := ServerTiming{Name: name}
+			for _, param := range params[1:] {
+				eq := strings.Index(param, "=")
+				if eq < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(param[:eq]))
+				val := unquote(strings.TrimSpace(param[eq+1:]))
+				switch key {
+				case "dur":
+					if ms, err := strconv.ParseFloat(val, 64); err == nil {
+						timing.Duration = time.Duration(ms * float64(time.Millisecond))
+					}
+				case "desc":
+					timing.Description = val
+				}
+			}
+			timings = append(timings, timing)
+		}
+	}
+	return timings
+}
+
+// splitQuoted splits s at sep, ignoring separators inside quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	var quoted, escaped bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote removes the quotes and escapes of an HTTP quoted-string.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,27 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResult_ServerTimings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Server-Timing", `cache;desc="Cache Read, L2";dur=23.2, db;dur=53`)
+		w.Header().Add("Server-Timing", `miss`)
+	}))
+	defer srv.Close()
+
+	timings := NewRequest(srv.URL, "GET").Do().ServerTimings()
+	want := []ServerTiming{
+		{Name: "cache", Duration: 23200 * time.Microsecond, Description: "Cache Read, L2"},
+		{Name: "db", Duration: 53 * time.Millisecond},
+		{Name: "miss"},
+	}
+	if !reflect.DeepEqual(timings, want) {
+		t.Errorf("timings = %+v", timings)
+	}
+}
@@ -0,0 +1,57 @@
+package request
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/moby/spdystream"
+)
+
+// UpgradeSPDY upgrades the request to SPDY/3.1, as used by exec, attach and
+// port-forward in Kubernetes, and returns the multiplexed connection on
+// which streams are created with CreateStream. protocols are offered in
+// X-Stream-Protocol-Version and the one chosen by the server is returned.
+// The caller owns and must close the connection.
+func (r *Request) UpgradeSPDY(protocols ...string) (*spdystream.Connection, string, error) {
+	var negotiated string
+	conn, rw, err := r.upgrade("SPDY/3.1", func(req *http.Request) {
+		for _, p := range protocols {
+			req.Header.Add("X-Stream-Protocol-Version", p)
+		}
+	}, func(resp *http.Response) error {
+		negotiated = resp.Header.Get("X-Stream-Protocol-Version")
+		if len(protocols) == 0 {
+			return nil
+		}
+		for _, p := range protocols {
+			if p == negotiated {
+				return nil
+			}
+		}
+		return fmt.Errorf("server chose stream protocol %q, expected one of %v", negotiated, protocols)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	spdyConn, err := spdystream.NewConnection(&bufferedConn{Conn: conn, r: rw.Reader}, false)
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", err
+	}
+	go spdyConn.Serve(spdystream.NoOpStreamHandler)
+	return spdyConn, negotiated, nil
+}
+
+// bufferedConn reads through r so that data buffered during the handshake
+// is not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
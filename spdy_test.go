@@ -0,0 +1,62 @@
+package request
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moby/spdystream"
+)
+
+func TestRequest_UpgradeSPDY(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "SPDY/3.1" {
+			http.Error(w, "not a SPDY upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: SPDY/3.1\r\nConnection: Upgrade\r\n" +
+			"X-Stream-Protocol-Version: v4.channel.k8s.io\r\n\r\n")
+		_ = rw.Flush()
+		spdyConn, err := spdystream.NewConnection(conn, true)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go spdyConn.Serve(spdystream.MirrorStreamHandler)
+	}))
+	defer srv.Close()
+
+	conn, protocol, err := NewRequest(srv.URL, "POST").UpgradeSPDY("v4.channel.k8s.io", "v3.channel.k8s.io")
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	defer conn.Close()
+	if protocol != "v4.channel.k8s.io" {
+		t.Errorf("protocol = %q", protocol)
+	}
+
+	stream, err := conn.CreateStream(http.Header{"Streamtype": {"stdin"}}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, err = %v", buf, err)
+	}
+
+	if _, _, err := NewRequest(srv.URL, "POST").UpgradeSPDY("v5.channel.k8s.io"); err == nil {
+		t.Error("expected an error when the server chooses another protocol")
+	}
+}
@@ -0,0 +1,68 @@
+package request
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SpillToDiskOver writes response bodies larger than n bytes to a temporary
+// file instead of holding them in memory. Read such a body with
+// Result.BodyReader or WriteTo, and call Result.Close to remove the file.
+// IntoStream and the JSON path accessors read it from the file as well;
+// the other accessors, such as Raw, Into and Validate, load it into memory
+// first. Error responses, and the responses that SingleFlight shares, are
+// always kept in memory.
+func (r *Request) SpillToDiskOver(n int64) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.spillOver = n
+	return r
+}
+
+// spillFile is a response body stored in a temporary file.
+type spillFile struct {
+	f    *os.File
+	size int64
+}
+
+// reader returns a new reader over the whole body.
+func (s *spillFile) reader() io.Reader {
+	return io.NewSectionReader(s.f, 0, s.size)
+}
+
+// Close closes and removes the file.
+func (s *spillFile) Close() error {
+	err := s.f.Close()
+	if rerr := os.Remove(s.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// readBody reads src into memory, or into a spillFile once it exceeds
+// spillOver bytes when spill is set.
+func (r *Request) readBody(src io.Reader, spill bool) ([]byte, *spillFile, error) {
+	if !spill || r.spillOver <= 0 || r.coalescable() {
+		data, err := ioutil.ReadAll(src)
+		return data, nil, err
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(src, r.spillOver+1))
+	if err != nil || int64(len(head)) <= r.spillOver {
+		return head, nil, err
+	}
+
+	f, err := ioutil.TempFile("", "request-body-")
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &spillFile{f: f}
+	s.size, err = io.Copy(f, io.MultiReader(bytes.NewReader(head), src))
+	if err != nil {
+		_ = s.Close()
+		return nil, nil, err
+	}
+	return nil, s, nil
+}
@@ -0,0 +1,161 @@
+package request
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestRequest_SpillToDiskOver(t *testing.T) {
+	page := bytes.Repeat([]byte("0123456789"), 100<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(page)
+	}))
+	defer srv.Close()
+
+	res := NewRequest(srv.URL, "GET").SpillToDiskOver(64 << 10).Do()
+	if res.Error() != nil {
+		t.Fatal(res.Error())
+	}
+	if res.spill == nil || len(res.body) != 0 {
+		t.Fatalf("expected the body on disk, %d bytes in memory", len(res.body))
+	}
+	name := res.spill.f.Name()
+	if _, err := os.Stat(name); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(res.BodyReader())
+	if err != nil || !bytes.Equal(got, page) {
+		t.Errorf("body reader: %d bytes, %v", len(got), err)
+	}
+	var buf bytes.Buffer
+	if n, err := res.WriteTo(&buf); err != nil || n != int64(len(page)) || !bytes.Equal(buf.Bytes(), page) {
+		t.Errorf("write to: %d bytes, %v", n, err)
+	}
+
+	if err := res.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("temp file not removed: %v", err)
+	}
+
+	res = NewRequest(srv.URL, "GET").SpillToDiskOver(int64(len(page))).Do()
+	if res.spill != nil || !bytes.Equal(res.body, page) {
+		t.Error("a body at the threshold should stay in memory")
+	}
+}
+
+// contextDecoder is a ContextDecoder decoding JSON.
+type contextDecoder struct{}
+
+func (contextDecoder) Decode(data []byte, mediaType string, into interface{}) (interface{}, error) {
+	return NewDecode().Decode(data, "application/json", into)
+}
+
+func (d contextDecoder) DecodeContext(ctx context.Context, data []byte, mediaType string, into interface{}) (interface{}, error) {
+	return d.Decode(data, mediaType, into)
+}
+
+func TestRequest_SpillToDiskOverAccessors(t *testing.T) {
+	object := `{"name":"a","pad":"` + strings.Repeat("x", 4<<10) + `"}`
+	var stream bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&stream, "{\"n\":%d}\n", i)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/stream" {
+			_, _ = w.Write(stream.Bytes())
+			return
+		}
+		_, _ = w.Write([]byte(object))
+	}))
+	defer srv.Close()
+
+	do := func(path string) Result {
+		res := NewRequest(srv.URL, "GET").AbsPath(path).Decoder(contextDecoder{}).SpillToDiskOver(1 << 10).Do()
+		if res.spill == nil {
+			t.Fatalf("%s: body not spilled", path)
+		}
+		return res
+	}
+
+	res := do("/object")
+	defer res.Close()
+	var out struct{ Name string }
+	if err := res.IntoContext(context.Background(), &out); err != nil || out.Name != "a" {
+		t.Errorf("IntoContext: name = %q, err = %v", out.Name, err)
+	}
+	if name, ok := res.JSONString("name"); !ok || name != "a" {
+		t.Errorf("JSONString: %q, %v", name, ok)
+	}
+	var validated int
+	if err := res.Validate(func(body []byte) error {
+		validated = len(body)
+		return nil
+	}).Error(); err != nil || validated != len(object) {
+		t.Errorf("Validate: saw %d bytes, err = %v", validated, err)
+	}
+	if err := res.ValidateSchema([]byte(`{"type":"object","required":["name"]}`)); err != nil {
+		t.Errorf("ValidateSchema: %v", err)
+	}
+	if err := res.ValidateSchema([]byte(`{"type":"object","required":["id"]}`)); err == nil {
+		t.Error("ValidateSchema: expected the missing property to be reported")
+	}
+
+	res = do("/stream")
+	defer res.Close()
+	var records []struct{ N int }
+	if err := res.IntoStream(&records); err != nil || len(records) != 1000 || records[999].N != 999 {
+		t.Errorf("IntoStream: %d records, err = %v", len(records), err)
+	}
+}
+
+func TestRequest_SpillToDiskOverSingleFlight(t *testing.T) {
+	page := bytes.Repeat([]byte("0123456789"), 10<<10)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write(page)
+	}))
+	defer srv.Close()
+
+	var group singleflight.Group
+	var wg sync.WaitGroup
+	results := make([]Result, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = NewRequest(srv.URL, "GET").SpillToDiskOver(1 << 10).SingleFlight(&group).Do()
+		}(i)
+	}
+	// give both goroutines the chance to join the flight before it lands.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if !results[0].Coalesced() || !results[1].Coalesced() {
+		t.Fatal("expected the results to be shared")
+	}
+	if err := results[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(results[1].BodyReader())
+	if err != nil || !bytes.Equal(got, page) {
+		t.Errorf("body after the other caller closed: %d bytes, %v", len(got), err)
+	}
+}
@@ -0,0 +1,105 @@
+package request
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings are the durations of the phases of the last attempt of a request,
+// recorded when CollectTimings is set. Phases that did not happen, such as
+// DNS for an IP address or all of them on a reused connection, are zero.
+type Timings struct {
+	DNSLookup    time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// FirstByte is the time from writing the request to the first byte of
+	// the response.
+	FirstByte time.Duration
+}
+
+// ClientTrace attaches trace to every request, e.g. to log connection reuse
+// or the phases of a request.
+func (r *Request) ClientTrace(trace *httptrace.ClientTrace) *Request {
+	if r.err != nil {
+		return r
+	}
+	r.trace = trace
+	return r
+}
+
+// CollectTimings records the durations of DNS lookup, connect, TLS
+// handshake and time to first byte in Stats().Timings of the result.
+func (r *Request) CollectTimings() *Request {
+	if r.err != nil {
+		return r
+	}
+	r.collectTimings = true
+	return r
+}
+
+// timingsKey is the context key of the *timingsRecorder of a request.
+type timingsKey struct{}
+
+type timingsRecorder struct {
+	mu      sync.Mutex
+	timings Timings
+
+	dnsStart, connectStart, tlsStart, wrote time.Time
+}
+
+// withTrace attaches the client trace and the timings recorder of the
+// request to ctx.
+func (r *Request) withTrace(ctx context.Context) context.Context {
+	if r.trace != nil {
+		ctx = httptrace.WithClientTrace(ctx, r.trace)
+	}
+	if !r.collectTimings {
+		return ctx
+	}
+	rec := &timingsRecorder{}
+	ctx = context.WithValue(ctx, timingsKey{}, rec)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { rec.start(&rec.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { rec.done(rec.dnsStart, &rec.timings.DNSLookup) },
+		ConnectStart: func(network, addr string) {
+			rec.start(&rec.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			rec.done(rec.connectStart, &rec.timings.Connect)
+		},
+		TLSHandshakeStart: func() { rec.start(&rec.tlsStart) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			rec.done(rec.tlsStart, &rec.timings.TLSHandshake)
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { rec.start(&rec.wrote) },
+		GotFirstResponseByte: func() { rec.done(rec.wrote, &rec.timings.FirstByte) },
+	})
+}
+
+func (rec *timingsRecorder) start(t *time.Time) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	*t = time.Now()
+}
+
+func (rec *timingsRecorder) done(start time.Time, d *time.Duration) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !start.IsZero() {
+		*d = time.Since(start)
+	}
+}
+
+// collectedTimings returns the timings recorded for ctx, if any.
+func collectedTimings(ctx context.Context) Timings {
+	rec, ok := ctx.Value(timingsKey{}).(*timingsRecorder)
+	if !ok {
+		return Timings{}
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.timings
+}
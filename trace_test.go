@@ -0,0 +1,35 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+)
+
+func TestRequest_ClientTrace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	// a hostname makes the transport resolve it.
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	var dns, connect bool
+	res := NewRequest(url, "GET").ClientTrace(&httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { dns = true },
+		ConnectStart: func(network, addr string) { connect = true },
+	}).CollectTimings().Do()
+	if err := res.Error(); err != nil {
+		t.Fatal("err", err.Error())
+	}
+	if !dns || !connect {
+		t.Errorf("dns = %v, connect = %v", dns, connect)
+	}
+	timings := res.Stats().Timings
+	if timings.DNSLookup <= 0 || timings.Connect <= 0 || timings.FirstByte <= 0 {
+		t.Errorf("timings = %+v", timings)
+	}
+	if timings.TLSHandshake != 0 {
+		t.Errorf("TLS handshake over plain http: %v", timings.TLSHandshake)
+	}
+}
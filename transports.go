@@ -0,0 +1,93 @@
+package request
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+)
+
+// transportKey identifies the effective TLS configuration of a transport in
+// the registry.
+type transportKey struct {
+	skipVerify bool
+	minVersion uint16
+	maxVersion uint16
+	serverName string
+}
+
+// maxSharedTransports bounds the registry. The least recently used transport
+// is evicted beyond it; requests still holding it keep working and its idle
+// connections are closed.
+const maxSharedTransports = 32
+
+var (
+	transportsMu sync.Mutex
+	transports   = map[transportKey]*http.Transport{}
+	// transportOrder lists the keys of transports, least recently used
+	// first.
+	transportOrder []transportKey
+	// sharedDialer dials the connections of the registered transports.
+	sharedDialer = newConnDialer()
+)
+
+// sharedTransport returns the transport registered for config, creating it
+// the first time, so that requests with the same TLS options share their
+// connections. It reports false for a config with its own session cache,
+// root CAs or client certificates, which is then given a transport of its
+// own.
+func sharedTransport(config *tls.Config) (*http.Transport, bool) {
+	if config.ClientSessionCache != defaultSessionCache || config.RootCAs != nil ||
+		len(config.Certificates) > 0 || config.GetClientCertificate != nil {
+		return nil, false
+	}
+	key := transportKey{
+		skipVerify: config.InsecureSkipVerify,
+		minVersion: config.MinVersion,
+		maxVersion: config.MaxVersion,
+		serverName: config.ServerName,
+	}
+
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	for i, k := range transportOrder {
+		if k == key {
+			transportOrder = append(append(transportOrder[:i:i], transportOrder[i+1:]...), key)
+			break
+		}
+	}
+	if t, ok := transports[key]; ok {
+		return t, true
+	}
+	if len(transportOrder) >= maxSharedTransports {
+		oldest := transportOrder[0]
+		transports[oldest].CloseIdleConnections()
+		delete(transports, oldest)
+		transportOrder = transportOrder[1:]
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = sharedDialer.DialContext
+	t.TLSClientConfig = config.Clone()
+	transports[key] = t
+	transportOrder = append(transportOrder, key)
+	return t, true
+}
+
+// configureTLS applies fn to the TLS configuration of the request. A
+// transport from the registry is replaced by the one registered for the new
+// configuration rather than copied.
+func (r *Request) configureTLS(fn func(*tls.Config)) error {
+	if r.sharedTLS {
+		config := r.client.Transport.(*http.Transport).TLSClientConfig.Clone()
+		fn(config)
+		if t, ok := sharedTransport(config); ok {
+			r.httpClient().Transport = t
+			return nil
+		}
+	}
+	config, err := r.tlsConfig()
+	if err != nil {
+		return err
+	}
+	fn(config)
+	return nil
+}
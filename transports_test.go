@@ -0,0 +1,57 @@
+package request
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"testing"
+)
+
+func TestRequest_SharedTransport(t *testing.T) {
+	a := NewRequest("https://127.0.0.1/", "GET").TLSVersion(tls.VersionTLS12, 0).TLSServerName("api")
+	b := NewRequest("https://127.0.0.1/", "GET").TLSVersion(tls.VersionTLS12, 0).TLSServerName("api")
+	if a.client == b.client || a.client.Transport != b.client.Transport {
+		t.Error("requests with the same TLS options should share one transport")
+	}
+
+	c := NewRequest("https://127.0.0.1/", "GET").TLSVersion(tls.VersionTLS13, 0).TLSServerName("api")
+	if c.client.Transport == a.client.Transport {
+		t.Error("requests with other TLS options should not share a transport")
+	}
+
+	// configuring anything else copies the shared transport.
+	shared := a.client.Transport
+	a.MaxConnsPerHost(1)
+	if a.client.Transport == shared || b.client.Transport != shared {
+		t.Error("the shared transport was modified")
+	}
+
+	// root CAs and client certificates are never shared.
+	if _, ok := sharedTransport(&tls.Config{ClientSessionCache: defaultSessionCache, RootCAs: x509.NewCertPool()}); ok {
+		t.Error("a config with root CAs should get a transport of its own")
+	}
+}
+
+func TestRequest_SharedTransportBounded(t *testing.T) {
+	first := NewRequest("https://127.0.0.1/", "GET").TLSServerName("host-0").client.Transport
+	for i := 1; i <= maxSharedTransports; i++ {
+		NewRequest("https://127.0.0.1/", "GET").TLSServerName(fmt.Sprintf("host-%d", i))
+	}
+	transportsMu.Lock()
+	n := len(transports)
+	transportsMu.Unlock()
+	if n > maxSharedTransports {
+		t.Errorf("%d transports registered", n)
+	}
+	if NewRequest("https://127.0.0.1/", "GET").TLSServerName("host-0").client.Transport == first {
+		t.Error("the least recently used transport should have been evicted")
+	}
+
+	// a session cache of the caller is not a key of the registry.
+	cache := tls.NewLRUClientSessionCache(1)
+	a := NewRequest("https://127.0.0.1/", "GET").TLSSessionCache(cache)
+	b := NewRequest("https://127.0.0.1/", "GET").TLSSessionCache(cache)
+	if a.sharedTLS || a.client.Transport == b.client.Transport {
+		t.Error("a custom session cache should get a transport of its own")
+	}
+}
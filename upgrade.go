@@ -0,0 +1,136 @@
+package request
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// websocketGUID is appended to Sec-WebSocket-Key to compute
+// Sec-WebSocket-Accept, see RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Upgrade performs a WebSocket opening handshake and returns the upgraded
+// connection with a buffered reader and writer over it; the reader may
+// already hold data sent by the server. The request is sent on a connection
+// of its own, bypassing proxies, and Timeout only bounds the handshake. The
+// caller owns and must close the connection. Framing is left to the caller.
+func (r *Request) Upgrade() (net.Conn, *bufio.ReadWriter, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	return r.upgrade("websocket", func(req *http.Request) {
+		req.Header.Set("Sec-WebSocket-Key", key)
+		req.Header.Set("Sec-WebSocket-Version", "13")
+	}, func(resp *http.Response) error {
+		sum := sha1.Sum([]byte(key + websocketGUID))
+		if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+			return fmt.Errorf("invalid Sec-WebSocket-Accept %q", resp.Header.Get("Sec-WebSocket-Accept"))
+		}
+		return nil
+	})
+}
+
+// upgrade switches the connection of the request to protocol. prepare adds
+// the headers of the protocol to the request and check verifies the
+// 101 Switching Protocols response.
+func (r *Request) upgrade(protocol string, prepare func(*http.Request), check func(*http.Response) error) (net.Conn, *bufio.ReadWriter, error) {
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	ctx, cancel := r.requestContext()
+	defer cancel()
+
+	req, err := r.newHTTPRequest(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	prepare(req)
+
+	conn, err := r.dialUpgrade(req)
+	if err != nil {
+		return nil, nil, wrapTimeout(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := func() (*http.Response, error) {
+		if err := req.Write(conn); err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(br, req)
+	}()
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, wrapTimeout(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		err := r.transformResponse(resp, req).Error()
+		_ = conn.Close()
+		if err == nil {
+			err = fmt.Errorf("unable to upgrade to %s: server responded with %s", protocol, resp.Status)
+		}
+		return nil, nil, err
+	}
+	if err := check(resp); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, bufio.NewReadWriter(br, bufio.NewWriter(conn)), nil
+}
+
+// dialUpgrade opens a connection to the host of req with the dialer and TLS
+// configuration of the request.
+func (r *Request) dialUpgrade(req *http.Request) (net.Conn, error) {
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	var dialer interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	} = &net.Dialer{Timeout: 30 * time.Second}
+	if r.dialer != nil {
+		dialer = r.dialer
+	}
+	conn, err := dialer.DialContext(req.Context(), "tcp", net.JoinHostPort(host, port))
+	if err != nil || req.URL.Scheme != "https" {
+		return conn, err
+	}
+
+	config := &tls.Config{}
+	if r.client != nil {
+		if t, ok := r.client.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+			config = t.TLSClientConfig.Clone()
+		}
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	config.NextProtos = nil
+	tlsConn := tls.Client(conn, config)
+	if deadline, ok := req.Context().Deadline(); ok {
+		_ = tlsConn.SetDeadline(deadline)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
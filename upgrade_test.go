@@ -0,0 +1,51 @@
+package request
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequest_Upgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+			http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+			return
+		}
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+		_ = rw.Flush()
+		line, _ := rw.ReadString('\n')
+		_, _ = rw.WriteString("echo " + line)
+		_ = rw.Flush()
+	}))
+	defer srv.Close()
+
+	conn, rw, err := NewRequest(srv.URL, "GET").Upgrade()
+	if err != nil {
+		t.Fatal("err", err.Error())
+	}
+	defer conn.Close()
+	_, _ = rw.WriteString("ping\n")
+	if err := rw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := rw.ReadString('\n'); err != nil || line != "echo ping\n" {
+		t.Errorf("line = %q, err = %v", line, err)
+	}
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	if _, _, err := NewRequest(plain.URL, "GET").Upgrade(); err == nil {
+		t.Error("expected an error from a server that does not upgrade")
+	}
+}